@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// ecsCredentialsHost serves AWS_CONTAINER_CREDENTIALS_RELATIVE_URI in ECS tasks.
+	ecsCredentialsHost = "http://169.254.170.2"
+	identityTimeout    = 5 * time.Second
+)
+
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// awsConfig builds the AWS configuration of a target, with the credentials of
+// its profile or credential source, and assuming its role when role_arn is set.
+func awsConfig(ctx context.Context, target Target) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(target.Region)}
+	if target.RetryMode != "" {
+		opts = append(opts, config.WithRetryMode(aws.RetryMode(target.RetryMode)))
+	}
+	if target.MaxAttempts > 0 {
+		opts = append(opts, config.WithRetryMaxAttempts(target.MaxAttempts))
+	}
+	if target.ProxyURL != "" {
+		proxy, err := url.Parse(target.ProxyURL)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		client := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.Proxy = http.ProxyURL(proxy)
+		})
+		opts = append(opts, config.WithHTTPClient(client))
+	}
+	profile := target.Profile
+	if profile == "" && target.CredentialSource == credentialSourceSharedConfig {
+		profile = os.Getenv("AWS_PROFILE")
+		if profile == "" {
+			profile = "default"
+		}
+	}
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	provider, err := credentialsProvider(target, awsCfg)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if provider != nil {
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	if target.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg, stsEndpoint(target)), target.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			if target.ExternalID != "" {
+				o.ExternalID = aws.String(target.ExternalID)
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return awsCfg, nil
+}
+
+// stsEndpoint applies the STS endpoint override of target, as STS is called for
+// the caller identity and the roles to assume.
+func stsEndpoint(target Target) func(*sts.Options) {
+	return func(o *sts.Options) {
+		if target.Endpoints.STS != "" {
+			o.BaseEndpoint = aws.String(target.Endpoints.STS)
+		}
+	}
+}
+
+// credentialsProvider returns the provider of the static credential files or of
+// the credential source of target, or nil to use the default credential chain.
+func credentialsProvider(target Target, awsCfg aws.Config) (aws.CredentialsProvider, error) {
+	if target.AccessKeyIDFile != "" {
+		accessKeyID, err := readSecretFile(target.AccessKeyIDFile)
+		if err != nil {
+			return nil, err
+		}
+		secretAccessKey, err := readSecretFile(target.SecretAccessKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var sessionToken string
+		if target.SessionTokenFile != "" {
+			sessionToken, err = readSecretFile(target.SessionTokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken), nil
+	}
+
+	switch target.CredentialSource {
+	case credentialSourceEnv:
+		envCfg, err := config.NewEnvConfig()
+		if err != nil {
+			return nil, err
+		}
+		if !envCfg.Credentials.HasKeys() {
+			return nil, errors.New("credential_source env: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+		}
+		return credentials.StaticCredentialsProvider{Value: envCfg.Credentials}, nil
+	case credentialSourceECS:
+		endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+			endpoint = ecsCredentialsHost + uri
+		}
+		if endpoint == "" {
+			return nil, errors.New("credential_source ecs: AWS_CONTAINER_CREDENTIALS_RELATIVE_URI and AWS_CONTAINER_CREDENTIALS_FULL_URI are not set")
+		}
+		return endpointcreds.New(endpoint, func(o *endpointcreds.Options) {
+			o.AuthorizationToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		}), nil
+	case credentialSourceWebIdentity:
+		tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		roleARN := os.Getenv("AWS_ROLE_ARN")
+		if tokenFile == "" || roleARN == "" {
+			return nil, errors.New("credential_source web_identity: AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN are not set")
+		}
+		return stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(awsCfg, stsEndpoint(target)), roleARN, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+		}), nil
+	}
+	return nil, nil
+}
+
+// maskAccessKeyID keeps only the first and last four characters of an access key ID.
+func maskAccessKeyID(id string) string {
+	if len(id) <= 8 {
+		return "****"
+	}
+	return id[:4] + "****" + id[len(id)-4:]
+}
+
+// logIdentity logs the credentials and the identity the exporter uses, so that
+// a misconfigured deployment is obvious from its logs. It gives up after
+// identityTimeout, as STS may be unreachable where only the monitored APIs are.
+func (e *Exporter) logIdentity(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, identityTimeout)
+	defer cancel()
+	logger := slog.With("region", e.region)
+	creds, err := e.credentials.Retrieve(ctx)
+	if err != nil {
+		logger.Warn("failed to retrieve AWS credentials", "err", err)
+		return
+	}
+	logger = logger.With("credentials_source", creds.Source, "access_key_id", maskAccessKeyID(creds.AccessKeyID))
+	identity, err := e.stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		logger.Warn("failed to get caller identity", "err", err)
+		return
+	}
+	logger.Info("using AWS identity", "account", aws.ToString(identity.Account), "arn", aws.ToString(identity.Arn))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+const (
+	// 30 minutes of samples at the 1 second MonitoringInterval
+	defaultBufferMaxSamples   = 1800
+	defaultBufferMaxBytes     = 64 << 20
+	defaultBufferPollInterval = 30 * time.Second
+
+	// reasons samples are evicted from the buffer
+	evictRetention = "retention"
+	evictCapacity  = "capacity"
+	evictMemory    = "memory"
+)
+
+// sample is a decoded Enhanced Monitoring event.
+type sample struct {
+	timestamp int64
+	metrics   RDSOSMetrics
+	// size is the length of the raw event, used to estimate the memory in use
+	size int
+}
+
+// sampleRing holds the samples of one instance, oldest first. It grows up to
+// max samples and then overwrites the oldest one.
+type sampleRing struct {
+	buf   []sample
+	start int
+	n     int
+	max   int
+}
+
+func (r *sampleRing) at(i int) *sample {
+	return &r.buf[(r.start+i)%len(r.buf)]
+}
+
+// push appends s and returns the sample it overwrote, if any.
+func (r *sampleRing) push(s sample) (sample, bool) {
+	if r.n == len(r.buf) && len(r.buf) < r.max {
+		buf := make([]sample, min(max(2*len(r.buf), 16), r.max))
+		for i := 0; i < r.n; i++ {
+			buf[i] = *r.at(i)
+		}
+		r.buf = buf
+		r.start = 0
+	}
+	if r.n < len(r.buf) {
+		*r.at(r.n) = s
+		r.n++
+		return sample{}, false
+	}
+	evicted := r.buf[r.start]
+	r.buf[r.start] = s
+	r.start = (r.start + 1) % len(r.buf)
+	return evicted, true
+}
+
+func (r *sampleRing) pop() sample {
+	s := r.buf[r.start]
+	r.buf[r.start] = sample{}
+	r.start = (r.start + 1) % len(r.buf)
+	r.n--
+	return s
+}
+
+// SampleBuffer keeps the recent samples of every instance in memory, bounded by
+// a retention, a number of samples per instance and an estimated size in bytes.
+// It is shared by every exporter, so the memory limit applies to all regions.
+type SampleBuffer struct {
+	retention  time.Duration
+	maxSamples int
+	maxBytes   int64
+	now        func() time.Time
+	created    time.Time
+
+	mu      sync.Mutex
+	rings   map[string]*sampleRing
+	bytes   int64
+	evicted map[string]uint64
+}
+
+func NewSampleBuffer(retention time.Duration, maxSamples int, maxBytes int64) *SampleBuffer {
+	return &SampleBuffer{
+		retention:  retention,
+		maxSamples: maxSamples,
+		maxBytes:   maxBytes,
+		now:        time.Now,
+		created:    time.Now(),
+		rings:      make(map[string]*sampleRing),
+		evicted:    make(map[string]uint64),
+	}
+}
+
+// add buffers a sample of resourceID. Samples not newer than the latest one are
+// ignored, as scrapes and the collector read the same events.
+func (b *SampleBuffer) add(resourceID string, timestamp int64, m RDSOSMetrics, size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	threshold := b.now().Add(-b.retention).UnixMilli()
+	if timestamp < threshold {
+		return
+	}
+	r, ok := b.rings[resourceID]
+	if !ok {
+		r = &sampleRing{max: b.maxSamples}
+		b.rings[resourceID] = r
+	}
+	if r.n > 0 && timestamp <= r.at(r.n-1).timestamp {
+		return
+	}
+	if evicted, ok := r.push(sample{timestamp: timestamp, metrics: m, size: size}); ok {
+		b.bytes -= int64(evicted.size)
+		b.evicted[evictCapacity]++
+	}
+	b.bytes += int64(size)
+	b.expire(threshold)
+	for b.bytes > b.maxBytes {
+		if !b.evictOldest() {
+			break
+		}
+	}
+}
+
+// expire drops the samples older than threshold. b.mu must be held.
+func (b *SampleBuffer) expire(threshold int64) {
+	for resourceID, r := range b.rings {
+		for r.n > 0 && r.at(0).timestamp < threshold {
+			b.bytes -= int64(r.pop().size)
+			b.evicted[evictRetention]++
+		}
+		if r.n == 0 {
+			delete(b.rings, resourceID)
+		}
+	}
+}
+
+// evictOldest drops the oldest sample of all instances. b.mu must be held.
+func (b *SampleBuffer) evictOldest() bool {
+	var oldest string
+	for resourceID, r := range b.rings {
+		if oldest == "" || r.at(0).timestamp < b.rings[oldest].at(0).timestamp {
+			oldest = resourceID
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	r := b.rings[oldest]
+	b.bytes -= int64(r.pop().size)
+	b.evicted[evictMemory]++
+	if r.n == 0 {
+		delete(b.rings, oldest)
+	}
+	return true
+}
+
+// samples returns the buffered samples of resourceID at or after since, in milliseconds.
+func (b *SampleBuffer) samples(resourceID string, since int64) ([]sample, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(b.now().Add(-b.retention).UnixMilli())
+	r, ok := b.rings[resourceID]
+	if !ok {
+		return nil, false
+	}
+	samples := make([]sample, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		if s := r.at(i); s.timestamp >= since {
+			samples = append(samples, *s)
+		}
+	}
+	return samples, true
+}
+
+// latest returns the timestamp of the newest sample of resourceID.
+func (b *SampleBuffer) latest(resourceID string) (int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.rings[resourceID]
+	if !ok {
+		return 0, false
+	}
+	return r.at(r.n - 1).timestamp, true
+}
+
+// metrics returns the buffer metrics in the text exposition format.
+func (b *SampleBuffer) metrics() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	samples := 0
+	for _, r := range b.rings {
+		samples += r.n
+	}
+	buf := []string{
+		fmt.Sprintf("%s_exporter_buffer_instances %d", namespace, len(b.rings)),
+		fmt.Sprintf("%s_exporter_buffer_samples %d", namespace, samples),
+		fmt.Sprintf("%s_exporter_buffer_bytes %d", namespace, b.bytes),
+		fmt.Sprintf("%s_exporter_buffer_max_bytes %d", namespace, b.maxBytes),
+	}
+	for _, reason := range []string{evictRetention, evictCapacity, evictMemory} {
+		label := Labels{"reason": reason}
+		buf = append(buf,
+			fmt.Sprintf("%s_exporter_buffer_evicted_samples_total{%s} %d", namespace, label, b.evicted[reason]),
+			fmt.Sprintf("%s_exporter_buffer_evicted_samples_created{%s} %s", namespace, label, formatSeconds(b.created)),
+		)
+	}
+	return buf
+}
+
+type samplesResponse struct {
+	ResourceID string       `json:"resourceId"`
+	Samples    []sampleJSON `json:"samples"`
+}
+
+type sampleJSON struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Metrics   RDSOSMetrics `json:"metrics"`
+}
+
+// parseSince parses the since parameter as RFC 3339, Unix seconds or a duration
+// before now, and returns it in milliseconds.
+func parseSince(v string, now time.Time) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UnixMilli(), nil
+	}
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+		return int64(seconds * 1000), nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d).UnixMilli(), nil
+	}
+	return 0, fmt.Errorf("invalid since %q: expected RFC 3339, Unix seconds or a duration", v)
+}
+
+// samplesHandler serves the buffered samples of the {resourceId} instance.
+func (b *SampleBuffer) samplesHandler(w http.ResponseWriter, r *http.Request) {
+	resourceID := r.PathValue("resourceId")
+	since, err := parseSince(r.URL.Query().Get("since"), b.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples, ok := b.samples(resourceID, since)
+	if !ok {
+		http.Error(w, "no samples buffered for "+resourceID, http.StatusNotFound)
+		return
+	}
+	resp := samplesResponse{ResourceID: resourceID, Samples: make([]sampleJSON, 0, len(samples))}
+	for _, s := range samples {
+		resp.Samples = append(resp.Samples, sampleJSON{Timestamp: time.UnixMilli(s.timestamp).UTC(), Metrics: s.metrics})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runSampleCollector reads every event of the active streams into the sample
+// buffer every samplePollInterval until ctx is done, so that the buffer holds
+// every sample and not only those read by scrapes.
+func (e *Exporter) runSampleCollector(ctx context.Context) {
+	if e.samples == nil || e.samplePollInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(e.samplePollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			streams, err := e.activeStreams(ctx)
+			if err != nil {
+				slog.Warn("failed to list streams to buffer", "region", e.region, "err", err)
+				continue
+			}
+			streams = e.selectStreams(streams)
+			sort.Strings(streams)
+			for _, s := range streams {
+				if err := e.bufferStream(ctx, s); err != nil {
+					e.deduper.log(ctx, slog.LevelWarn, "buffer:"+s, "failed to buffer stream", "region", e.region, "stream", s, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// bufferStream reads the events of stream s published since its latest buffered
+// sample, or within the retention, into the sample buffer.
+func (e *Exporter) bufferStream(ctx context.Context, s string) error {
+	start := e.samples.now().Add(-e.samples.retention).UnixMilli()
+	if latest, ok := e.samples.latest(s); ok && latest >= start {
+		start = latest + 1
+	}
+	input := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String("RDSOSMetrics"),
+		LogStreamName: aws.String(s),
+		StartFromHead: aws.Bool(true),
+		StartTime:     aws.Int64(start),
+	}
+	for {
+		output, err := e.cwLogsClient.GetLogEvents(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, event := range output.Events {
+			var m RDSOSMetrics
+			if err := json.Unmarshal([]byte(*event.Message), &m); err != nil {
+				return err
+			}
+			e.samples.add(s, *event.Timestamp, m, len(*event.Message))
+		}
+		// the forward token is returned unchanged at the end of the stream
+		if len(output.Events) == 0 || output.NextForwardToken == nil ||
+			input.NextToken != nil && *output.NextForwardToken == *input.NextToken {
+			return nil
+		}
+		input.NextToken = output.NextForwardToken
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cloudwatchlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+var bufferTestNow = time.Unix(1700000000, 0)
+
+func newTestSampleBuffer(maxSamples int, maxBytes int64) *SampleBuffer {
+	b := NewSampleBuffer(30*time.Minute, maxSamples, maxBytes)
+	b.now = func() time.Time { return bufferTestNow }
+	return b
+}
+
+// secondsAgo returns the timestamp, in milliseconds, of n seconds before bufferTestNow.
+func secondsAgo(n int) int64 {
+	return bufferTestNow.Add(-time.Duration(n) * time.Second).UnixMilli()
+}
+
+func TestSampleBufferCapacity(t *testing.T) {
+	b := newTestSampleBuffer(20, 1<<20)
+	for i := 100; i > 0; i-- {
+		b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(i), RDSOSMetrics{NumVCPUs: float64(i)}, 10)
+	}
+	// not newer than the latest sample
+	b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(50), RDSOSMetrics{}, 10)
+
+	samples, ok := b.samples("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", 0)
+	if !ok {
+		t.Fatal("expected samples")
+	}
+	if len(samples) != 20 {
+		t.Fatalf("expected %d, got %d", 20, len(samples))
+	}
+	if samples[0].metrics.NumVCPUs != 20 || samples[19].metrics.NumVCPUs != 1 {
+		t.Errorf("expected the 20 newest samples in order, got %v to %v", samples[0].metrics.NumVCPUs, samples[19].metrics.NumVCPUs)
+	}
+
+	metrics := strings.Join(b.metrics(), "\n")
+	for _, expect := range []string{
+		"rds_enhanced_monitoring_exporter_buffer_samples 20",
+		"rds_enhanced_monitoring_exporter_buffer_bytes 200",
+		`rds_enhanced_monitoring_exporter_buffer_evicted_samples_total{reason="capacity"} 80`,
+	} {
+		if !strings.Contains(metrics, expect) {
+			t.Errorf("expected %s, got %s", expect, metrics)
+		}
+	}
+}
+
+func TestSampleBufferRetention(t *testing.T) {
+	b := newTestSampleBuffer(defaultBufferMaxSamples, 1<<20)
+	b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(3600), RDSOSMetrics{}, 10)
+	b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(120), RDSOSMetrics{}, 10)
+	b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(60), RDSOSMetrics{}, 10)
+	if samples, _ := b.samples("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", 0); len(samples) != 2 {
+		t.Errorf("expected a sample older than the retention to be ignored, got %d samples", len(samples))
+	}
+
+	bufferTestNow = bufferTestNow.Add(29 * time.Minute)
+	defer func() { bufferTestNow = bufferTestNow.Add(-29 * time.Minute) }()
+	samples, _ := b.samples("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", 0)
+	if len(samples) != 1 {
+		t.Errorf("expected %d, got %d", 1, len(samples))
+	}
+	metrics := strings.Join(b.metrics(), "\n")
+	if !strings.Contains(metrics, `rds_enhanced_monitoring_exporter_buffer_evicted_samples_total{reason="retention"} 1`) {
+		t.Errorf("expected retention eviction to be reported, got %s", metrics)
+	}
+}
+
+func TestSampleBufferMemory(t *testing.T) {
+	b := newTestSampleBuffer(defaultBufferMaxSamples, 100)
+	for i := 60; i > 0; i-- {
+		b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(2*i), RDSOSMetrics{}, 10)
+		b.add("db-BBBBBBBBBBBBBBBBBBBBBBBBBB", secondsAgo(2*i-1), RDSOSMetrics{}, 10)
+	}
+	a, _ := b.samples("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", 0)
+	bb, _ := b.samples("db-BBBBBBBBBBBBBBBBBBBBBBBBBB", 0)
+	if len(a) != 5 || len(bb) != 5 {
+		t.Errorf("expected the oldest samples of all instances to be evicted, got %d and %d", len(a), len(bb))
+	}
+	metrics := strings.Join(b.metrics(), "\n")
+	if !strings.Contains(metrics, `rds_enhanced_monitoring_exporter_buffer_evicted_samples_total{reason="memory"} 110`) {
+		t.Errorf("expected memory eviction to be reported, got %s", metrics)
+	}
+}
+
+func TestSamplesHandler(t *testing.T) {
+	b := newTestSampleBuffer(defaultBufferMaxSamples, 1<<20)
+	for i := 10; i > 0; i-- {
+		b.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(i), RDSOSMetrics{NumVCPUs: float64(i)}, 10)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/instances/{resourceId}/samples", b.samplesHandler)
+
+	tests := []struct {
+		since  string
+		expect int
+	}{
+		{"", 10},
+		{"3s", 3},
+		{strconv.FormatInt(bufferTestNow.Unix()-5, 10), 5},
+		{bufferTestNow.Add(-7 * time.Second).Format(time.RFC3339), 7},
+	}
+	for _, tt := range tests {
+		writer := httptest.NewRecorder()
+		mux.ServeHTTP(writer, httptest.NewRequest("GET", "/api/v1/instances/db-AAAAAAAAAAAAAAAAAAAAAAAAAA/samples?since="+tt.since, nil))
+		if writer.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, writer.Code)
+		}
+		var resp samplesResponse
+		if err := json.Unmarshal(writer.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Samples) != tt.expect {
+			t.Errorf("expected %d samples since %q, got %d", tt.expect, tt.since, len(resp.Samples))
+		}
+	}
+
+	writer := httptest.NewRecorder()
+	mux.ServeHTTP(writer, httptest.NewRequest("GET", "/api/v1/instances/db-BBBBBBBBBBBBBBBBBBBBBBBBBB/samples", nil))
+	if writer.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, writer.Code)
+	}
+	writer = httptest.NewRecorder()
+	mux.ServeHTTP(writer, httptest.NewRequest("GET", "/api/v1/instances/db-AAAAAAAAAAAAAAAAAAAAAAAAAA/samples?since=yesterday", nil))
+	if writer.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, writer.Code)
+	}
+}
+
+// pagingCloudWatchLogs serves one event per second of the last minute, pageSize events per page.
+type pagingCloudWatchLogs struct {
+	mockedCloudWatchLogs
+	pageSize int
+	calls    int
+}
+
+func (c *pagingCloudWatchLogs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	c.calls++
+	offset := 0
+	if input.NextToken != nil {
+		offset, _ = strconv.Atoi(strings.TrimPrefix(*input.NextToken, "f/"))
+	}
+	output := &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String(fmt.Sprintf("f/%d", offset))}
+	for i := 60 - offset; i > 0 && len(output.Events) < c.pageSize; i-- {
+		timestamp := secondsAgo(i)
+		if timestamp < *input.StartTime {
+			offset++
+			continue
+		}
+		output.Events = append(output.Events, cloudwatchlogsTypes.OutputLogEvent{
+			Timestamp: aws.Int64(timestamp),
+			Message:   aws.String(fmt.Sprintf(`{"numVCPUs":%d}`, i)),
+		})
+		offset++
+	}
+	if len(output.Events) > 0 {
+		output.NextForwardToken = aws.String(fmt.Sprintf("f/%d", offset))
+	}
+	return output, nil
+}
+
+func TestBufferStream(t *testing.T) {
+	cw := &pagingCloudWatchLogs{pageSize: 25}
+	e := NewExporterWithClients(cw, &mockedRDS{}, &mockedRGT{})
+	e.samples = newTestSampleBuffer(defaultBufferMaxSamples, 1<<20)
+
+	// a scrape already buffered the sample of 30 seconds ago
+	e.samples.add("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", secondsAgo(30), RDSOSMetrics{NumVCPUs: 30}, 10)
+	if err := e.bufferStream(context.Background(), "db-AAAAAAAAAAAAAAAAAAAAAAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	samples, _ := e.samples.samples("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", 0)
+	if len(samples) != 30 {
+		t.Errorf("expected %d, got %d", 30, len(samples))
+	}
+	if got := samples[len(samples)-1].metrics.NumVCPUs; got != 1 {
+		t.Errorf("expected %v, got %v", 1, got)
+	}
+	if cw.calls != 3 {
+		t.Errorf("expected pages to be read until the token repeats, got %d calls", cw.calls)
+	}
+}
@@ -1,19 +1,95 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
+// regionPattern matches region names such as us-east-1 or us-gov-west-1.
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// envPattern matches ${VAR} references to environment variables.
+var envPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// credential sources of a target; the default credential chain is used when empty
+const (
+	credentialSourceEnv          = "env"
+	credentialSourceSharedConfig = "shared_config"
+	credentialSourceECS          = "ecs"
+	credentialSourceWebIdentity  = "web_identity"
+)
+
 type Config struct {
 	Targets []Target `yaml:"targets"`
+
+	// targetLines are the lines of the targets in the file, when they are known
+	targetLines []int
 }
 
+// Target is a region to export. Its fields may refer to environment variables
+// as ${VAR}, and secrets may be read from files with the _file variants.
 type Target struct {
-	Region string `yaml:"region"`
+	Region         string `yaml:"region"`
+	RoleARN        string `yaml:"role_arn,omitempty"`
+	ExternalID     string `yaml:"external_id,omitempty"`
+	ExternalIDFile string `yaml:"external_id_file,omitempty"`
+
+	Profile             string `yaml:"profile,omitempty"`
+	CredentialSource    string `yaml:"credential_source,omitempty"`
+	AccessKeyIDFile     string `yaml:"access_key_id_file,omitempty"`
+	SecretAccessKeyFile string `yaml:"secret_access_key_file,omitempty"`
+	SessionTokenFile    string `yaml:"session_token_file,omitempty"`
+
+	Endpoints   Endpoints `yaml:"endpoints,omitempty"`
+	ProxyURL    string    `yaml:"proxy_url,omitempty"`
+	RetryMode   string    `yaml:"retry_mode,omitempty"`
+	MaxAttempts int       `yaml:"max_attempts,omitempty"`
+
+	Filters Filters `yaml:"filters,omitempty"`
 }
 
+// Filters select the instances to export. Every condition that is set has to
+// match. Identifier patterns are anchored regular expressions, and tag selectors
+// follow the Kubernetes label selector syntax: key=value, key!=value,
+// key in (v1,v2), key notin (v1,v2), key and !key.
+type Filters struct {
+	Engines                []string `yaml:"engines,omitempty"`
+	ExcludeEngines         []string `yaml:"exclude_engines,omitempty"`
+	InstanceClasses        []string `yaml:"instance_classes,omitempty"`
+	ExcludeInstanceClasses []string `yaml:"exclude_instance_classes,omitempty"`
+	TagSelectors           []string `yaml:"tag_selectors,omitempty"`
+	Identifier             string   `yaml:"identifier,omitempty"`
+	ExcludeIdentifier      string   `yaml:"exclude_identifier,omitempty"`
+}
+
+func (f Filters) empty() bool {
+	return len(f.Engines) == 0 && len(f.ExcludeEngines) == 0 &&
+		len(f.InstanceClasses) == 0 && len(f.ExcludeInstanceClasses) == 0 &&
+		len(f.TagSelectors) == 0 && f.Identifier == "" && f.ExcludeIdentifier == ""
+}
+
+// Endpoints override the endpoint URLs of the AWS APIs, e.g. for VPC endpoints
+// or local stand-ins.
+type Endpoints struct {
+	Logs    string `yaml:"logs,omitempty"`
+	RDS     string `yaml:"rds,omitempty"`
+	Tagging string `yaml:"tagging,omitempty"`
+	STS     string `yaml:"sts,omitempty"`
+	SQS     string `yaml:"sqs,omitempty"`
+}
+
+// LoadConfig reads the configuration file. Unknown keys are rejected, and
+// decoding errors include the line they were found on.
 func LoadConfig(configFile string) (*Config, error) {
 	buf, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -21,10 +97,271 @@ func LoadConfig(configFile string) (*Config, error) {
 	}
 
 	var cfg Config
-	err = yaml.Unmarshal(buf, &cfg)
+	err = yaml.UnmarshalStrict(buf, &cfg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+	if lines := targetLines(buf); len(lines) == len(cfg.Targets) {
+		cfg.targetLines = lines
+	}
+	if err := cfg.expand(); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+	cfg.normalize()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
 	}
 
 	return &cfg, nil
 }
+
+// expandEnv replaces ${VAR} in s with the value of the environment variable.
+// Unset variables are errors rather than empty strings.
+func expandEnv(s string) (string, error) {
+	var errs []error
+	expanded := envPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if !envNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("invalid variable name: %q", name))
+			return ref
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("environment variable %s is not set", name))
+			return ref
+		}
+		return v
+	})
+	return expanded, errors.Join(errs...)
+}
+
+// readSecretFile returns the content of path without the trailing newline.
+func readSecretFile(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(buf), "\r\n"), nil
+}
+
+// targetLines returns the line of every item of the top-level targets list, as
+// yaml.v2 does not report the position of decoded values. Only the block style
+// is recognized; the result has fewer lines than targets otherwise.
+func targetLines(buf []byte) []int {
+	var lines []int
+	inTargets := false
+	indent := -1
+	for i, line := range strings.Split(string(buf), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		depth := len(line) - len(trimmed)
+		item := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if depth == 0 && !item {
+			inTargets = strings.HasPrefix(trimmed, "targets:")
+			indent = -1
+			continue
+		}
+		if !inTargets || !item {
+			continue
+		}
+		if indent < 0 {
+			indent = depth
+		}
+		if depth == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+// targetError prefixes err with the index of the target, and its line when known.
+func (c *Config) targetError(i int, err error) error {
+	if i < len(c.targetLines) {
+		return fmt.Errorf("line %d: targets[%d]: %w", c.targetLines[i], i, err)
+	}
+	return fmt.Errorf("targets[%d]: %w", i, err)
+}
+
+// expand resolves the environment variables and secret files of the targets.
+func (c *Config) expand() error {
+	var errs []error
+	for i := range c.Targets {
+		if err := c.Targets[i].expand(); err != nil {
+			errs = append(errs, c.targetError(i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Target) expand() error {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"region", &t.Region},
+		{"role_arn", &t.RoleARN},
+		{"external_id", &t.ExternalID},
+		{"external_id_file", &t.ExternalIDFile},
+		{"endpoints.logs", &t.Endpoints.Logs},
+		{"endpoints.rds", &t.Endpoints.RDS},
+		{"endpoints.tagging", &t.Endpoints.Tagging},
+		{"endpoints.sts", &t.Endpoints.STS},
+		{"endpoints.sqs", &t.Endpoints.SQS},
+		{"proxy_url", &t.ProxyURL},
+		{"profile", &t.Profile},
+		{"access_key_id_file", &t.AccessKeyIDFile},
+		{"secret_access_key_file", &t.SecretAccessKeyFile},
+		{"session_token_file", &t.SessionTokenFile},
+	}
+	for _, f := range fields {
+		v, err := expandEnv(*f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*f.value = v
+	}
+
+	if t.ExternalIDFile != "" {
+		if t.ExternalID != "" {
+			return errors.New("external_id and external_id_file are mutually exclusive")
+		}
+		v, err := readSecretFile(t.ExternalIDFile)
+		if err != nil {
+			return fmt.Errorf("external_id_file: %w", err)
+		}
+		t.ExternalID = v
+		t.ExternalIDFile = ""
+	}
+	return nil
+}
+
+func (c *Config) normalize() {
+	for i := range c.Targets {
+		c.Targets[i].Region = strings.TrimSpace(c.Targets[i].Region)
+	}
+}
+
+// validate reports every problem of the configuration at once.
+func (c *Config) validate() error {
+	var errs []error
+	seen := make(map[string]int)
+	for i, t := range c.Targets {
+		if err := t.validate(); err != nil {
+			errs = append(errs, c.targetError(i, err))
+			continue
+		}
+		if j, ok := seen[t.Region]; ok {
+			errs = append(errs, c.targetError(i, fmt.Errorf("duplicate target of targets[%d], the filters of a region belong in a single target", j)))
+			continue
+		}
+		seen[t.Region] = i
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Target) validate() error {
+	if t.Region == "" {
+		return errors.New("region must not be empty")
+	}
+	if !regionPattern.MatchString(t.Region) {
+		return fmt.Errorf("invalid region: %q", t.Region)
+	}
+	if t.ExternalID != "" && t.RoleARN == "" {
+		return errors.New("external_id requires role_arn")
+	}
+	if t.RoleARN != "" && !strings.HasPrefix(t.RoleARN, "arn:") {
+		return fmt.Errorf("invalid role_arn: %q", t.RoleARN)
+	}
+	urls := []struct {
+		name  string
+		value string
+	}{
+		{"endpoints.logs", t.Endpoints.Logs},
+		{"endpoints.rds", t.Endpoints.RDS},
+		{"endpoints.tagging", t.Endpoints.Tagging},
+		{"endpoints.sts", t.Endpoints.STS},
+		{"endpoints.sqs", t.Endpoints.SQS},
+		{"proxy_url", t.ProxyURL},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			continue
+		}
+		if err := validateURL(u.value); err != nil {
+			return fmt.Errorf("%s: %w", u.name, err)
+		}
+	}
+	switch t.RetryMode {
+	case "", "standard", "adaptive":
+	default:
+		return fmt.Errorf("invalid retry_mode: %q", t.RetryMode)
+	}
+	if t.MaxAttempts < 0 {
+		return fmt.Errorf("invalid max_attempts: %d", t.MaxAttempts)
+	}
+	if _, err := newInstanceFilter(t.Filters); err != nil {
+		return fmt.Errorf("filters: %w", err)
+	}
+	return t.validateCredentials()
+}
+
+func (t *Target) validateCredentials() error {
+	static := t.AccessKeyIDFile != "" || t.SecretAccessKeyFile != "" || t.SessionTokenFile != ""
+	if static && (t.AccessKeyIDFile == "" || t.SecretAccessKeyFile == "") {
+		return errors.New("access_key_id_file and secret_access_key_file must be set together")
+	}
+	switch t.CredentialSource {
+	case "":
+	case credentialSourceSharedConfig:
+	case credentialSourceEnv, credentialSourceECS, credentialSourceWebIdentity:
+		if t.Profile != "" {
+			return fmt.Errorf("profile can not be used with credential_source %s", t.CredentialSource)
+		}
+	default:
+		return fmt.Errorf("invalid credential_source: %q", t.CredentialSource)
+	}
+	if static && (t.CredentialSource != "" || t.Profile != "") {
+		return errors.New("static credentials can not be used with profile or credential_source")
+	}
+	return nil
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL: %q", s)
+	}
+	return nil
+}
+
+// checkConfig loads and validates configFile and writes the normalized
+// configuration to w, with secrets masked.
+func checkConfig(w io.Writer, configFile string) error {
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	buf, err := cfg.masked()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// masked returns the configuration as YAML, with secrets masked.
+func (c *Config) masked() ([]byte, error) {
+	masked := Config{Targets: make([]Target, len(c.Targets))}
+	copy(masked.Targets, c.Targets)
+	for i := range masked.Targets {
+		if masked.Targets[i].ExternalID != "" {
+			masked.Targets[i].ExternalID = "<secret>"
+		}
+	}
+	return yaml.Marshal(masked)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigInvalid(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	tests := []struct {
+		content string
+		expect  string
+	}{
+		{"targets:\n  - region: us-east-1\n  - regoin: us-west-2\n", "line 3: field regoin not found"},
+		{"target:\n  - region: us-east-1\n", "line 1: field target not found"},
+		{"targets:\n  - region: \"\"\n", "targets[0]: region must not be empty"},
+		{"targets:\n  - region: US-EAST-1\n", "targets[0]: invalid region"},
+		{"targets:\n  - region: us-east-1\n  - region: us-east-1 \n", "line 3: targets[1]: duplicate target of targets[0]"},
+		{"targets:\n  - region: us-east-1\n  - region: us-east-1\n    filters:\n      engines: [mysql]\n", "targets[1]: duplicate target of targets[0]"},
+		{"targets:\n  - region: us-east-1\n    endpoints:\n      logs: localhost:4566\n", "line 2: targets[0]: endpoints.logs: invalid URL"},
+		{"# exported regions\ntargets:\n- region: us-east-1\n  role_arn: role\n- region: us-west-2\n  retry_mode: legacy\n", "line 5: targets[1]: invalid retry_mode"},
+		{"targets: [{region: us-east-1}, {region: US}]\n", "targets[1]: invalid region"},
+		{"targets:\n  - region: us-east-1\n    endpoints:\n      sts: localhost:4566\n", "targets[0]: endpoints.sts: invalid URL"},
+		{"targets:\n  - region: us-east-1\n    endpoints:\n      ec2: http://localhost:4566\n", "line 4: field ec2 not found"},
+		{"targets:\n  - region: us-east-1\n    proxy_url: ftp://proxy\n", "targets[0]: proxy_url: invalid URL"},
+		{"targets:\n  - region: us-east-1\n    retry_mode: legacy\n", "targets[0]: invalid retry_mode"},
+		{"targets:\n  - region: us-east-1\n    credential_source: instance\n", "targets[0]: invalid credential_source"},
+		{"targets:\n  - region: us-east-1\n    filters:\n      identifier: \"db-(\"\n", "targets[0]: filters: identifier: error parsing regexp"},
+		{"targets:\n  - region: us-east-1\n    filters:\n      tag_selectors: [\"Environment in ()\"]\n", "targets[0]: filters: empty set"},
+		{"targets:\n  - region: us-east-1\n    profile: ops\n    credential_source: env\n", "profile can not be used with credential_source env"},
+		{"targets:\n  - region: us-east-1\n    access_key_id_file: a\n", "must be set together"},
+		{"targets:\n  - region: us-east-1\n    profile: ops\n    access_key_id_file: a\n    secret_access_key_file: b\n", "static credentials can not be used"},
+	}
+	for _, tt := range tests {
+		writeConfig(t, configFile, tt.content)
+		_, err := LoadConfig(configFile)
+		if err == nil {
+			t.Errorf("expected error for %q", tt.content)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expect) {
+			t.Errorf("expected %s, got %s", tt.expect, err)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: ' us-gov-west-1 '\n  - region: ap-northeast-1\n")
+	var out bytes.Buffer
+	if err := checkConfig(&out, configFile); err != nil {
+		t.Fatal(err)
+	}
+	expect := "targets:\n- region: us-gov-west-1\n- region: ap-northeast-1\n"
+	if expect != out.String() {
+		t.Errorf("expected %s, got %s", expect, out.String())
+	}
+}
+
+func TestLoadConfigExpansion(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	secretFile := filepath.Join(dir, "external_id")
+	writeConfig(t, secretFile, "s3cr3t\n")
+	t.Setenv("TEST_AWS_REGION", "ap-northeast-1")
+	t.Setenv("TEST_AWS_ACCOUNT", "123456789012")
+	t.Setenv("TEST_SECRET_DIR", dir)
+	writeConfig(t, configFile, `targets:
+  - region: ${TEST_AWS_REGION}
+    role_arn: arn:aws:iam::${TEST_AWS_ACCOUNT}:role/rds-exporter
+    external_id_file: ${TEST_SECRET_DIR}/external_id
+`)
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Target{
+		Region:     "ap-northeast-1",
+		RoleARN:    "arn:aws:iam::123456789012:role/rds-exporter",
+		ExternalID: "s3cr3t",
+	}
+	if !reflect.DeepEqual(expect, cfg.Targets[0]) {
+		t.Errorf("expected %+v, got %+v", expect, cfg.Targets[0])
+	}
+
+	var out bytes.Buffer
+	if err := checkConfig(&out, configFile); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cr3t") {
+		t.Errorf("expected external_id to be masked, got %s", out.String())
+	}
+}
+
+func TestLoadConfigExpansionInvalid(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	tests := []struct {
+		content string
+		expect  string
+	}{
+		{"targets:\n  - region: ${TEST_UNSET_VARIABLE}\n", "targets[0]: region: environment variable TEST_UNSET_VARIABLE is not set"},
+		{"targets:\n  - region: ${1REGION}\n", "invalid variable name"},
+		{"targets:\n  - region: us-east-1\n    role_arn: arn:aws:iam::123456789012:role/a\n    external_id: a\n    external_id_file: b\n", "mutually exclusive"},
+		{"targets:\n  - region: us-east-1\n    role_arn: arn:aws:iam::123456789012:role/a\n    external_id_file: /nonexistent\n", "external_id_file"},
+		{"targets:\n  - region: us-east-1\n    external_id: a\n", "external_id requires role_arn"},
+	}
+	for _, tt := range tests {
+		writeConfig(t, configFile, tt.content)
+		_, err := LoadConfig(configFile)
+		if err == nil {
+			t.Errorf("expected error for %q", tt.content)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expect) {
+			t.Errorf("expected %s, got %s", tt.expect, err)
+		}
+	}
+}
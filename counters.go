@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+const (
+	// counterCatchUpWindow bounds how far back the events missed since the
+	// latest accumulated one are read
+	counterCatchUpWindow = time.Hour
+	// counterMaxPages bounds the GetLogEvents calls per stream and scrape, the
+	// remaining events are read by the next scrape
+	counterMaxPages = 20
+	// counterRetention is how long the counters of a stream without events are kept
+	counterRetention = 24 * time.Hour
+)
+
+// counterValue is the total of a delta field of a stream, with the labels of
+// the device it belongs to.
+type counterValue struct {
+	name   string
+	labels Labels
+	value  float64
+}
+
+// counterState holds the counters accumulated from the events of a stream.
+type counterState struct {
+	// timestamp is the time of the latest accumulated event, in milliseconds
+	timestamp int64
+	// uptime of the instance at the latest accumulated event, negative when unknown
+	uptime  time.Duration
+	created time.Time
+	// values are keyed by name and labels
+	values map[string]counterValue
+}
+
+var uptimePattern = regexp.MustCompile(`^(?:(\d+) days?, )?(\d+):(\d{2}):(\d{2})$`)
+
+// parseUptime parses the uptime of an event, as "1 day, 2:03:04" or "2:03:04".
+func parseUptime(s string) (time.Duration, error) {
+	match := uptimePattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("invalid uptime %q", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(match[i+1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// deltaFields returns the delta fields of m keyed by name and device labels.
+func deltaFields(m RDSOSMetrics) map[string]counterValue {
+	fields := make(map[string]counterValue)
+	walkMetrics(m, "", Labels{}, func(name string, kind string, label Labels, value float64) {
+		if kind == fieldDelta {
+			fields[name+"{"+label.String()+"}"] = counterValue{name: name, labels: label, value: value}
+		}
+	})
+	return fields
+}
+
+// outputGaugeMetrics is outputMetrics without the delta fields, which are
+// exported as counters instead.
+func outputGaugeMetrics(buf []string, m RDSOSMetrics, format string, label Labels) []string {
+	walkMetrics(m, "", label, func(name string, kind string, label Labels, value float64) {
+		if kind != fieldDelta {
+			buf = append(buf, fmt.Sprintf(format, name, label, value))
+		}
+	})
+	return buf
+}
+
+// accumulate adds the delta fields of the event of stream s at timestamp to its
+// counters. The counters start at zero from the first event, and restart when
+// the uptime of the instance goes back, as on reboot. Events at or before the
+// latest accumulated one are ignored, so that every event is counted once.
+func (e *Exporter) accumulate(s string, timestamp int64, m RDSOSMetrics) {
+	uptime, err := parseUptime(m.Uptime)
+	if err != nil {
+		uptime = -1
+	}
+	fields := deltaFields(m)
+
+	e.counterLock.Lock()
+	defer e.counterLock.Unlock()
+	state, ok := e.counters[s]
+	if ok && timestamp <= state.timestamp {
+		return
+	}
+	at := time.UnixMilli(timestamp)
+	switch {
+	case !ok:
+		state = &counterState{created: at, values: make(map[string]counterValue)}
+		for k, f := range fields {
+			f.value = 0
+			state.values[k] = f
+		}
+		e.counters[s] = state
+	case uptime >= 0 && state.uptime >= 0 && uptime < state.uptime:
+		// the deltas of the event are the first since the restart
+		state.created = at.Add(-uptime)
+		state.values = fields
+	default:
+		for k, f := range fields {
+			if v, ok := state.values[k]; ok {
+				f.value += v.value
+			}
+			state.values[k] = f
+		}
+	}
+	state.timestamp = timestamp
+	state.uptime = uptime
+}
+
+// accumulateStream accumulates the events of stream s published since its
+// latest accumulated event, within counterCatchUpWindow, so that the intervals
+// between scrapes are all counted. Without counters yet, only the latest event
+// is read.
+func (e *Exporter) accumulateStream(ctx context.Context, s string) error {
+	e.counterLock.Lock()
+	state, ok := e.counters[s]
+	var start int64
+	if ok {
+		start = state.timestamp + 1
+	}
+	e.counterLock.Unlock()
+
+	input := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String("RDSOSMetrics"),
+		LogStreamName: aws.String(s),
+		StartFromHead: aws.Bool(ok),
+	}
+	if ok {
+		input.StartTime = aws.Int64(max(start, time.Now().Add(-counterCatchUpWindow).UnixMilli()))
+	} else {
+		input.Limit = aws.Int32(1)
+	}
+	for page := 0; page < counterMaxPages; page++ {
+		output, err := e.cwLogsClient.GetLogEvents(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, event := range output.Events {
+			var m RDSOSMetrics
+			if err := json.Unmarshal([]byte(*event.Message), &m); err != nil {
+				return err
+			}
+			e.accumulate(s, *event.Timestamp, m)
+		}
+		// the forward token is returned unchanged at the end of the stream
+		if !ok || len(output.Events) == 0 || output.NextForwardToken == nil ||
+			input.NextToken != nil && *output.NextForwardToken == *input.NextToken {
+			return nil
+		}
+		input.NextToken = output.NextForwardToken
+	}
+	return nil
+}
+
+// counterSeries returns the counters of stream s as series with label, at the
+// time of its latest accumulated event.
+func (e *Exporter) counterSeries(s string, label Labels) []string {
+	e.counterLock.Lock()
+	defer e.counterLock.Unlock()
+	state, ok := e.counters[s]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(state.values))
+	for k := range state.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	format := seriesFormat(state.timestamp)
+	created := formatSeconds(state.created)
+	buf := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		v := state.values[k]
+		l := make(Labels)
+		for k, v := range label {
+			l[k] = v
+		}
+		for k, v := range v.labels {
+			l[k] = v
+		}
+		buf = append(buf,
+			fmt.Sprintf(format, v.name+"_total", l, v.value),
+			fmt.Sprintf("%s_%s_created{%s} %s", namespace, v.name, l, created),
+		)
+	}
+	return buf
+}
+
+// pruneCounters drops the counters of the streams without events for counterRetention.
+func (e *Exporter) pruneCounters(now time.Time) {
+	e.counterLock.Lock()
+	defer e.counterLock.Unlock()
+	for s, state := range e.counters {
+		if now.Sub(time.UnixMilli(state.timestamp)) > counterRetention {
+			delete(e.counters, s)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cloudwatchlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// counterCloudWatchLogs pages through events two at a time, as GetLogEvents does
+// with StartTime, StartFromHead and the forward token.
+type counterCloudWatchLogs struct {
+	mockedCloudWatchLogs
+	events []cloudwatchlogsTypes.OutputLogEvent
+	calls  int
+}
+
+func (c *counterCloudWatchLogs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	c.calls++
+	events := make([]cloudwatchlogsTypes.OutputLogEvent, 0)
+	for _, event := range c.events {
+		if input.StartTime == nil || *event.Timestamp >= *input.StartTime {
+			events = append(events, event)
+		}
+	}
+	if !aws.ToBool(input.StartFromHead) {
+		if input.Limit != nil && len(events) > int(*input.Limit) {
+			events = events[len(events)-int(*input.Limit):]
+		}
+		return &cloudwatchlogs.GetLogEventsOutput{Events: events}, nil
+	}
+	offset := 0
+	if input.NextToken != nil {
+		offset, _ = strconv.Atoi(*input.NextToken)
+	}
+	end := min(offset+2, len(events))
+	return &cloudwatchlogs.GetLogEventsOutput{
+		Events:           events[min(offset, end):end],
+		NextForwardToken: aws.String(strconv.Itoa(end)),
+	}, nil
+}
+
+func counterEvent(at time.Time, uptime string, readKb float64) cloudwatchlogsTypes.OutputLogEvent {
+	return cloudwatchlogsTypes.OutputLogEvent{
+		Timestamp: aws.Int64(at.UnixMilli()),
+		Message:   aws.String(fmt.Sprintf(`{"uptime":%q,"diskIO":[{"device":"rdsdev","readKb":%g,"readKbPS":1}],"swap":{"in":1}}`, uptime, readKb)),
+	}
+}
+
+func TestParseUptime(t *testing.T) {
+	tests := []struct {
+		uptime string
+		expect time.Duration
+	}{
+		{"1 days, 00:00:00", 24 * time.Hour},
+		{"1 day, 2:03:04", 26*time.Hour + 3*time.Minute + 4*time.Second},
+		{"00:00:59", 59 * time.Second},
+	}
+	for _, tt := range tests {
+		got, err := parseUptime(tt.uptime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expect != got {
+			t.Errorf("expected %s for %q, got %s", tt.expect, tt.uptime, got)
+		}
+	}
+	if _, err := parseUptime("a while"); err == nil {
+		t.Error("expected invalid uptime to be rejected")
+	}
+}
+
+func TestAccumulate(t *testing.T) {
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	start := time.UnixMilli(1486977657000)
+	key := "DiskIO_ReadKb{Device=\"rdsdev\"}"
+	accumulate := func(at time.Time, uptime string, readKb float64) {
+		var m RDSOSMetrics
+		m.Uptime = uptime
+		m.DiskIO = []DiskIO{{Device: "rdsdev", ReadKb: readKb}}
+		e.accumulate("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", at.UnixMilli(), m)
+	}
+	value := func() float64 {
+		return e.counters["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"].values[key].value
+	}
+
+	accumulate(start, "1:00:00", 5)
+	if value() != 0 {
+		t.Errorf("expected counter to start at 0, got %f", value())
+	}
+	accumulate(start.Add(time.Minute), "1:01:00", 10)
+	accumulate(start.Add(2*time.Minute), "1:02:00", 20)
+	if value() != 30 {
+		t.Errorf("expected %f, got %f", 30.0, value())
+	}
+	accumulate(start.Add(time.Minute), "1:01:00", 10)
+	if value() != 30 {
+		t.Errorf("expected an accumulated event to be ignored, got %f", value())
+	}
+
+	accumulate(start.Add(3*time.Minute), "0:00:30", 7)
+	if value() != 7 {
+		t.Errorf("expected counter to restart on reboot, got %f", value())
+	}
+	expectCreated := start.Add(3*time.Minute - 30*time.Second)
+	if created := e.counters["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"].created; !created.Equal(expectCreated) {
+		t.Errorf("expected %s, got %s", expectCreated, created)
+	}
+}
+
+func TestAccumulateStream(t *testing.T) {
+	cw := &counterCloudWatchLogs{}
+	e := NewExporterWithClients(cw, &mockedRDS{}, &mockedRGT{})
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	cw.events = []cloudwatchlogsTypes.OutputLogEvent{counterEvent(start, "1:00:00", 1)}
+	if err := e.accumulateStream(context.Background(), "db-AAAAAAAAAAAAAAAAAAAAAAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the events between two scrapes are all counted, across pages
+	for i := 1; i <= 5; i++ {
+		cw.events = append(cw.events, counterEvent(start.Add(time.Duration(i)*time.Minute), fmt.Sprintf("1:%02d:00", i), float64(i)))
+	}
+	if err := e.accumulateStream(context.Background(), "db-AAAAAAAAAAAAAAAAAAAAAAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if cw.calls != 5 {
+		t.Errorf("expected %d, got %d", 5, cw.calls)
+	}
+
+	series := e.counterSeries("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", Labels{"DBInstanceIdentifier": "AAA"})
+	timestamp := strconv.FormatInt(start.Add(5*time.Minute).UnixMilli(), 10)
+	for _, expect := range []string{
+		`rds_enhanced_monitoring_DiskIO_ReadKb_total{DBInstanceIdentifier="AAA",Device="rdsdev"} 15.000000 ` + timestamp,
+		`rds_enhanced_monitoring_DiskIO_ReadKb_created{DBInstanceIdentifier="AAA",Device="rdsdev"} ` + formatSeconds(start),
+		`rds_enhanced_monitoring_Swap_In_total{DBInstanceIdentifier="AAA"} 5.000000 ` + timestamp,
+	} {
+		if !strings.Contains(strings.Join(series, "\n"), expect) {
+			t.Errorf("expected %s, got %v", expect, series)
+		}
+	}
+
+	openMetrics := formatOpenMetrics(series)
+	if !strings.Contains(openMetrics, "# TYPE rds_enhanced_monitoring_DiskIO_ReadKb counter\n") {
+		t.Errorf("expected delta field to be a counter, got %s", openMetrics)
+	}
+	if text := formatText(series); strings.Contains(text, "_created") {
+		t.Errorf("expected no _created series, got %s", text)
+	}
+
+	e.pruneCounters(start.Add(5*time.Minute + counterRetention + time.Second))
+	if series := e.counterSeries("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", nil); len(series) != 0 {
+		t.Errorf("expected stale counters to be dropped, got %v", series)
+	}
+}
+
+func TestOutputGaugeMetrics(t *testing.T) {
+	var m RDSOSMetrics
+	m.DiskIO = []DiskIO{{Device: "rdsdev", ReadKb: 1, ReadKbPS: 1}}
+	buf := strings.Join(outputGaugeMetrics(make([]string, 0), m, "%s{%s} %f", Labels{}), "\n")
+	if strings.Contains(buf, "DiskIO_ReadKb{") || strings.Contains(buf, "Swap_In{") {
+		t.Errorf("expected no delta fields, got %s", buf)
+	}
+	if !strings.Contains(buf, `DiskIO_ReadKbPS{Device="rdsdev"} 1.000000`) {
+		t.Errorf("expected rate fields, got %s", buf)
+	}
+	if got := lookupMetadata(namespace + "_DiskIO_ReadKb").Type; got != metricTypeGauge {
+		t.Errorf("expected %s, got %s", metricTypeGauge, got)
+	}
+}
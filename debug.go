@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+var errNoEvents = errors.New("no events")
+
+// debugReport shows how the latest event of an instance becomes series.
+type debugReport struct {
+	ResourceID string
+	Region     string
+	// Found is false when the instance is not in the inventory
+	Found     bool
+	Timestamp int64
+	Raw       string
+	Decoded   string
+	// DecodeError is set when the event does not decode into RDSOSMetrics
+	DecodeError string
+	Undecoded   []string
+	Series      []string
+	Labels      Labels
+	// FailedLabels maps the requested labels that could not be resolved to the reason
+	FailedLabels map[string]string
+}
+
+// jsonFieldName returns the name a struct field is decoded from.
+func jsonFieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// undecodedFields returns the paths of the fields of raw that have no
+// counterpart in t, matching names case-insensitively as encoding/json does.
+func undecodedFields(raw interface{}, t reflect.Type, path string) []string {
+	fields := make([]string, 0)
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return fields
+		}
+		for key, value := range obj {
+			var field *reflect.StructField
+			for i := 0; i < t.NumField(); i++ {
+				if f := t.Field(i); strings.EqualFold(jsonFieldName(f), key) {
+					field = &f
+					break
+				}
+			}
+			if field == nil {
+				fields = append(fields, path+key)
+				continue
+			}
+			fields = append(fields, undecodedFields(value, field.Type, path+key+".")...)
+		}
+	case reflect.Slice:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return fields
+		}
+		seen := make(map[string]bool)
+		for _, item := range items {
+			for _, f := range undecodedFields(item, t.Elem(), strings.TrimSuffix(path, ".")+"[].") {
+				if !seen[f] {
+					seen[f] = true
+					fields = append(fields, f)
+				}
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// seriesFormat returns the format of the series of an event at timestamp, in milliseconds.
+func seriesFormat(timestamp int64) string {
+	return namespace + "_%s{%s} %f " + strconv.FormatInt(timestamp/1000, 10) + "000"
+}
+
+// debugInstance reads the latest event of resourceID, without advancing any
+// cursor, and reports how it is decoded and exported with targetLabels.
+func (e *Exporter) debugInstance(ctx context.Context, resourceID string, targetLabels []string) (debugReport, error) {
+	report := debugReport{ResourceID: resourceID, Region: e.region}
+	events, err := e.cwLogsClient.GetLogEvents(ctx, &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String("RDSOSMetrics"),
+		LogStreamName: aws.String(resourceID),
+		StartFromHead: aws.Bool(false),
+		Limit:         aws.Int32(1),
+	})
+	if err != nil {
+		return report, err
+	}
+	if len(events.Events) == 0 {
+		return report, errNoEvents
+	}
+	event := events.Events[len(events.Events)-1]
+	report.Timestamp = aws.ToInt64(event.Timestamp)
+
+	var raw interface{}
+	if err := json.Unmarshal([]byte(aws.ToString(event.Message)), &raw); err != nil {
+		report.Raw = aws.ToString(event.Message)
+		report.DecodeError = err.Error()
+		return report, nil
+	}
+	pretty, _ := json.MarshalIndent(raw, "", "  ")
+	report.Raw = string(pretty)
+
+	var m RDSOSMetrics
+	if err := json.Unmarshal([]byte(aws.ToString(event.Message)), &m); err != nil {
+		report.DecodeError = err.Error()
+	}
+	decoded, _ := json.MarshalIndent(m, "", "  ")
+	report.Decoded = string(decoded)
+	report.Undecoded = undecodedFields(raw, reflect.TypeOf(m), "")
+
+	instance, ok := e.lookupInstance(ctx, resourceID)
+	report.Found = ok
+	if ok {
+		report.Labels, report.FailedLabels = e.resolveLabels(instance, targetLabels)
+	} else {
+		report.Labels = Labels{"ResourceId": resourceID}
+		report.FailedLabels = make(map[string]string)
+		for _, l := range targetLabels {
+			report.FailedLabels[l] = "instance is not found in the inventory"
+		}
+	}
+
+	format := seriesFormat(report.Timestamp)
+	report.Series = make([]string, 0)
+	if e.intervalCounters {
+		report.Series = outputGaugeMetrics(report.Series, m, format, report.Labels)
+	} else {
+		report.Series = outputMetrics(report.Series, m, format, "", report.Labels)
+	}
+	if e.derivedMetrics {
+		report.Series = outputDerivedMetrics(report.Series, m, format, report.Labels)
+	}
+	if e.intervalCounters {
+		// the counters as accumulated so far, the event is not added to them
+		report.Series = append(report.Series, e.counterSeries(resourceID, report.Labels)...)
+	}
+	return report, nil
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.ResourceID}} - RDS Enhanced Monitoring Exporter</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>{{.ResourceID}} ({{.Region}})</h1>
+{{if not .Found}}<p class="error">The instance is not found in the inventory.</p>
+{{end}}<p>Event timestamp: {{.Timestamp}}</p>
+{{if .DecodeError}}<p class="error">Decode error: {{.DecodeError}}</p>
+{{end}}
+<h2>Raw event</h2>
+<pre>{{.Raw}}</pre>
+
+<h2>Decoded RDSOSMetrics</h2>
+<pre>{{.Decoded}}</pre>
+
+<h2>Undecoded fields</h2>
+<ul>
+{{range .Undecoded}}<li>{{.}}</li>
+{{else}}<li>none</li>
+{{end}}</ul>
+
+<h2>Labels</h2>
+<table>
+<tr><th>Label</th><th>Value</th></tr>
+{{range $k, $v := .Labels}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>
+{{end}}</table>
+
+<h2>Failed label lookups</h2>
+<table>
+<tr><th>Label</th><th>Reason</th></tr>
+{{range $k, $v := .FailedLabels}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>
+{{end}}</table>
+
+<h2>Series</h2>
+<pre>{{range .Series}}{{.}}
+{{end}}</pre>
+</body>
+</html>
+`))
+
+// debugHandler shows how the latest event of the ResourceId instance is decoded
+// and exported, with the labels requested by labels[].
+func (r *Registry) debugHandler(w http.ResponseWriter, req *http.Request) {
+	region := req.URL.Query().Get("region")
+	e, ok := r.exporter(region)
+	if !ok {
+		http.Error(w, fmt.Sprintf("region %s is not a target", region), http.StatusBadRequest)
+		return
+	}
+	resourceID := req.URL.Query().Get("ResourceId")
+	if resourceID == "" {
+		http.Error(w, "ResourceId is required", http.StatusBadRequest)
+		return
+	}
+	report, err := e.debugInstance(req.Context(), resourceID, req.URL.Query()["labels[]"])
+	if errors.Is(err, errNoEvents) {
+		http.Error(w, "no events found for "+resourceID, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the latest event: %s", err), http.StatusBadGateway)
+		return
+	}
+	var buf bytes.Buffer
+	if err := debugTemplate.Execute(&buf, report); err != nil {
+		slog.Error("failed to render debug page", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cloudwatchlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// debugCloudWatchLogs returns one event with fields RDSOSMetrics does not know.
+type debugCloudWatchLogs struct {
+	mockedCloudWatchLogs
+}
+
+func (c *debugCloudWatchLogs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	if *input.LogStreamName == "db-ZZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		return &cloudwatchlogs.GetLogEventsOutput{}, nil
+	}
+	return &cloudwatchlogs.GetLogEventsOutput{
+		Events: []cloudwatchlogsTypes.OutputLogEvent{
+			{
+				Timestamp: aws.Int64(1486977657000),
+				Message:   aws.String(`{"engine":"MYSQL","numVCPUs":2,"newTopLevel":1,"memory":{"total":1024,"newField":1},"diskIO":[{"device":"rdsdev","readKb":1,"extra":1},{"device":"rdstemp","extra":2}]}`),
+			},
+		},
+	}, nil
+}
+
+func TestDebugInstance(t *testing.T) {
+	e := NewExporterWithClients(
+		&debugCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	if err := e.collectRdsInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := e.debugInstance(context.Background(), "db-AAAAAAAAAAAAAAAAAAAAAAAAAA", []string{"DBInstanceIdentifier", "tag_Missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectUndecoded := []string{"diskIO[].extra", "memory.newField", "newTopLevel"}
+	if !reflect.DeepEqual(expectUndecoded, report.Undecoded) {
+		t.Errorf("expected %v, got %v", expectUndecoded, report.Undecoded)
+	}
+	expectSeries := `rds_enhanced_monitoring_Memory_Total{DBInstanceIdentifier="AAA"} 1024.000000 1486977657000`
+	if !strings.Contains(strings.Join(report.Series, "\n"), expectSeries) {
+		t.Errorf("expected %s, got %v", expectSeries, report.Series)
+	}
+	if _, ok := report.FailedLabels["tag_Missing"]; !ok || len(report.FailedLabels) != 1 {
+		t.Errorf("expected only tag_Missing to fail, got %v", report.FailedLabels)
+	}
+	if _, ok := e.cursor("", "db-AAAAAAAAAAAAAAAAAAAAAAAAAA"); ok {
+		t.Error("expected no cursor to be advanced")
+	}
+
+	report, err = e.debugInstance(context.Background(), "db-CCCCCCCCCCCCCCCCCCCCCCCCCC", []string{"DBInstanceIdentifier"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Found {
+		t.Error("expected instance missing from the inventory to be reported")
+	}
+	if report.FailedLabels["DBInstanceIdentifier"] != "instance is not found in the inventory" {
+		t.Errorf("expected label lookup to fail, got %v", report.FailedLabels)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n")
+	r := newTestRegistry(t, configFile)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("")
+	e.cwLogsClient = &debugCloudWatchLogs{}
+
+	tests := []struct {
+		query  string
+		expect int
+	}{
+		{"", http.StatusBadRequest},
+		{"?ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA&region=eu-west-1", http.StatusBadRequest},
+		{"?ResourceId=db-ZZZZZZZZZZZZZZZZZZZZZZZZZZ", http.StatusNotFound},
+		{"?ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA&labels[]=DBInstanceIdentifier", http.StatusOK},
+	}
+	for _, tt := range tests {
+		writer := httptest.NewRecorder()
+		r.debugHandler(writer, httptest.NewRequest("GET", "/debug/instance"+tt.query, nil))
+		if writer.Code != tt.expect {
+			t.Errorf("expected %d for %q, got %d", tt.expect, tt.query, writer.Code)
+		}
+		if writer.Code == http.StatusOK && !strings.Contains(writer.Body.String(), "memory.newField") {
+			t.Errorf("expected undecoded fields to be shown, got %s", writer.Body.String())
+		}
+	}
+}
+
+func TestResolveLabels(t *testing.T) {
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	instance := rdsTypes.DBInstance{
+		DbiResourceId:        aws.String("db-DDDDDDDDDDDDDDDDDDDDDDDDDD"),
+		DBInstanceIdentifier: aws.String("DDD"),
+		Engine:               aws.String("postgres"),
+	}
+	e.instanceMap["db-DDDDDDDDDDDDDDDDDDDDDDDDDD"] = instance
+
+	label, failed := e.resolveLabels(instance, []string{"DBInstanceIdentifier", "DBSubnetGroup.VpcId", "StorageType", "RDSInstanceType", "tag_Name", "Unknown"})
+	if expect := (Labels{"DBInstanceIdentifier": "DDD"}); !reflect.DeepEqual(expect, label) {
+		t.Errorf("expected %v, got %v", expect, label)
+	}
+	expectFailed := map[string]string{
+		"DBSubnetGroup.VpcId": "DBSubnetGroup is not set",
+		"StorageType":         "StorageType is not set",
+		"RDSInstanceType":     "not applicable to the engine",
+		"tag_Name":            "tag is not set",
+		"Unknown":             "unknown label",
+	}
+	if !reflect.DeepEqual(expectFailed, failed) {
+		t.Errorf("expected %v, got %v", expectFailed, failed)
+	}
+
+	e.cwLogsClient = &debugCloudWatchLogs{}
+	report, err := e.debugInstance(context.Background(), "db-DDDDDDDDDDDDDDDDDDDDDDDDDD", []string{"DBInstanceIdentifier", "DBSubnetGroup.VpcId", "StorageType", "RDSInstanceType", "tag_Name", "Unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectFailed, report.FailedLabels) {
+		t.Errorf("expected %v, got %v", expectFailed, report.FailedLabels)
+	}
+}
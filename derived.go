@@ -0,0 +1,104 @@
+package main
+
+import "fmt"
+
+// outputDerivedMetrics appends series computed from the raw Enhanced Monitoring sample.
+// Names follow the same <Struct>_<Field> scheme used by outputMetrics.
+func outputDerivedMetrics(buf []string, m RDSOSMetrics, format string, label Labels) []string {
+	buf = append(buf, fmt.Sprintf(format, "Memory_Available", label, memoryAvailable(m.Memory)))
+	if v, ok := memoryUtilizationRatio(m.Memory); ok {
+		buf = append(buf, fmt.Sprintf(format, "Memory_UtilizationRatio", label, v))
+	}
+	buf = append(buf, fmt.Sprintf(format, "Swap_Used", label, swapUsed(m.Swap)))
+	buf = append(buf, fmt.Sprintf(format, "CpuUtilization_BusyExcludingSteal", label, cpuBusyExcludingSteal(m.CpuUtilization)))
+
+	loads := []struct {
+		name  string
+		value float64
+	}{
+		{"LoadAverageMinute_OnePerVCPU", m.LoadAverageMinute.One},
+		{"LoadAverageMinute_FivePerVCPU", m.LoadAverageMinute.Five},
+		{"LoadAverageMinute_FifteenPerVCPU", m.LoadAverageMinute.Fifteen},
+	}
+	for _, l := range loads {
+		if v, ok := loadPerVCPU(l.value, m.NumVCPUs); ok {
+			buf = append(buf, fmt.Sprintf(format, l.name, label, v))
+		}
+	}
+
+	for _, fs := range m.FileSys {
+		copiedLabel := copyLabels(label)
+		copiedLabel["MountPoint"] = fs.MountPoint
+		copiedLabel["Name"] = fs.Name
+		buf = append(buf, fmt.Sprintf(format, "FileSys_FreeBytes", copiedLabel, fileSysFreeBytes(fs)))
+		buf = append(buf, fmt.Sprintf(format, "FileSys_FreeFiles", copiedLabel, fileSysFreeFiles(fs)))
+	}
+
+	for _, n := range m.Network {
+		copiedLabel := copyLabels(label)
+		copiedLabel["Device"] = n.Interface
+		buf = append(buf, fmt.Sprintf(format, "Network_Total", copiedLabel, networkTotal(n)))
+	}
+
+	return buf
+}
+
+func copyLabels(label Labels) Labels {
+	copiedLabel := make(Labels, len(label))
+	for k, v := range label {
+		copiedLabel[k] = v
+	}
+	return copiedLabel
+}
+
+// memoryAvailable returns the memory that can be reclaimed without swapping, in KB.
+func memoryAvailable(m Memory) float64 {
+	return m.Free + m.Cached + m.Buffers
+}
+
+// memoryUtilizationRatio returns the used fraction (0-1) of total memory.
+func memoryUtilizationRatio(m Memory) (float64, bool) {
+	if m.Total <= 0 {
+		return 0, false
+	}
+	return (m.Total - memoryAvailable(m)) / m.Total, true
+}
+
+// swapUsed returns the swap space in use, in KB.
+func swapUsed(s Swap) float64 {
+	return s.Total - s.Free
+}
+
+// fileSysFreeBytes returns the free space of the file system in bytes.
+// The raw sample reports sizes in KB.
+func fileSysFreeBytes(fs FileSys) float64 {
+	return (fs.Total - fs.Used) * 1024
+}
+
+// fileSysFreeFiles returns the number of inodes that can still be allocated.
+func fileSysFreeFiles(fs FileSys) float64 {
+	return fs.MaxFiles - fs.UsedFiles
+}
+
+// cpuBusyExcludingSteal returns the CPU percentage spent on the instance's own work,
+// i.e. total utilization minus time stolen by the hypervisor.
+func cpuBusyExcludingSteal(c CpuUtilization) float64 {
+	busy := c.Total - c.Steal
+	if busy < 0 {
+		return 0
+	}
+	return busy
+}
+
+// loadPerVCPU normalizes a load average by the number of vCPUs.
+func loadPerVCPU(load float64, numVCPUs float64) (float64, bool) {
+	if numVCPUs <= 0 {
+		return 0, false
+	}
+	return load / numVCPUs, true
+}
+
+// networkTotal returns the combined receive and transmit throughput of an interface.
+func networkTotal(n Network) float64 {
+	return n.Rx + n.Tx
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMemoryAvailable(t *testing.T) {
+	got := memoryAvailable(Memory{Free: 95292, Cached: 1240780, Buffers: 206620, Total: 2051520})
+	if expect := 1542692.0; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+}
+
+func TestMemoryUtilizationRatio(t *testing.T) {
+	got, ok := memoryUtilizationRatio(Memory{Free: 100, Cached: 200, Buffers: 100, Total: 1000})
+	if !ok {
+		t.Fatal("expected ratio to be computed")
+	}
+	if expect := 0.6; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+
+	if _, ok := memoryUtilizationRatio(Memory{}); ok {
+		t.Error("expected no ratio when total is zero")
+	}
+}
+
+func TestSwapUsed(t *testing.T) {
+	got := swapUsed(Swap{Total: 4095996, Free: 4000000})
+	if expect := 95996.0; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+}
+
+func TestFileSysFreeBytes(t *testing.T) {
+	got := fileSysFreeBytes(FileSys{Total: 20496384, Used: 4748148})
+	if expect := 15748236.0 * 1024; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+}
+
+func TestFileSysFreeFiles(t *testing.T) {
+	got := fileSysFreeFiles(FileSys{MaxFiles: 1310720, UsedFiles: 1471})
+	if expect := 1309249.0; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+}
+
+func TestCpuBusyExcludingSteal(t *testing.T) {
+	got := cpuBusyExcludingSteal(CpuUtilization{Total: 12.5, Steal: 2.5})
+	if expect := 10.0; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+
+	got = cpuBusyExcludingSteal(CpuUtilization{Total: 0.01, Steal: 0.07})
+	if expect := 0.0; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+}
+
+func TestLoadPerVCPU(t *testing.T) {
+	got, ok := loadPerVCPU(3, 2)
+	if !ok {
+		t.Fatal("expected load per vCPU to be computed")
+	}
+	if expect := 1.5; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+
+	if _, ok := loadPerVCPU(3, 0); ok {
+		t.Error("expected no value when NumVCPUs is zero")
+	}
+}
+
+func TestNetworkTotal(t *testing.T) {
+	got := networkTotal(Network{Interface: "eth0", Rx: 1323.67, Tx: 5342})
+	if expect := 6665.67; expect != got {
+		t.Errorf("expected %f, got %f", expect, got)
+	}
+}
+
+func TestOutputDerivedMetrics(t *testing.T) {
+	m := RDSOSMetrics{
+		NumVCPUs:          2,
+		LoadAverageMinute: LoadAverageMinute{One: 1, Five: 2, Fifteen: 4},
+		Memory:            Memory{Free: 100, Cached: 200, Buffers: 100, Total: 1000},
+		FileSys:           []FileSys{{MountPoint: "/rdsdbdata", Name: "rdsfilesys", Total: 10, Used: 4, MaxFiles: 100, UsedFiles: 1}},
+		Network:           []Network{{Interface: "eth0", Rx: 1, Tx: 2}},
+	}
+	format := namespace + "_%s{%s} %f 1486977657000"
+	buf := outputDerivedMetrics(make([]string, 0), m, format, Labels{"DBInstanceIdentifier": "AAA"})
+	sort.Strings(buf)
+
+	expect := []string{
+		`rds_enhanced_monitoring_CpuUtilization_BusyExcludingSteal{DBInstanceIdentifier="AAA"} 0.000000 1486977657000`,
+		`rds_enhanced_monitoring_FileSys_FreeBytes{DBInstanceIdentifier="AAA",MountPoint="/rdsdbdata",Name="rdsfilesys"} 6144.000000 1486977657000`,
+		`rds_enhanced_monitoring_FileSys_FreeFiles{DBInstanceIdentifier="AAA",MountPoint="/rdsdbdata",Name="rdsfilesys"} 99.000000 1486977657000`,
+		`rds_enhanced_monitoring_LoadAverageMinute_FifteenPerVCPU{DBInstanceIdentifier="AAA"} 2.000000 1486977657000`,
+		`rds_enhanced_monitoring_LoadAverageMinute_FivePerVCPU{DBInstanceIdentifier="AAA"} 1.000000 1486977657000`,
+		`rds_enhanced_monitoring_LoadAverageMinute_OnePerVCPU{DBInstanceIdentifier="AAA"} 0.500000 1486977657000`,
+		`rds_enhanced_monitoring_Memory_Available{DBInstanceIdentifier="AAA"} 400.000000 1486977657000`,
+		`rds_enhanced_monitoring_Memory_UtilizationRatio{DBInstanceIdentifier="AAA"} 0.600000 1486977657000`,
+		`rds_enhanced_monitoring_Network_Total{DBInstanceIdentifier="AAA",Device="eth0"} 3.000000 1486977657000`,
+		`rds_enhanced_monitoring_Swap_Used{DBInstanceIdentifier="AAA"} 0.000000 1486977657000`,
+	}
+	if strings.Join(expect, "\n") != strings.Join(buf, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(buf, "\n"))
+	}
+}
+
+func TestDerivedMetricsLabels(t *testing.T) {
+	m := RDSOSMetrics{
+		Network: []Network{{Interface: "eth0", Rx: 1, Tx: 2}},
+	}
+	format := "%s{%s} %f"
+	labels := func(buf []string, prefix string) []string {
+		found := make([]string, 0)
+		for _, line := range buf {
+			if strings.HasPrefix(line, prefix) {
+				found = append(found, line[strings.Index(line, "{"):strings.Index(line, "}")+1])
+			}
+		}
+		return found
+	}
+
+	raw := labels(outputMetrics(make([]string, 0), m, format, "", Labels{}), "Network_Rx{")
+	derived := labels(outputDerivedMetrics(make([]string, 0), m, format, Labels{}), "Network_Total{")
+	if len(raw) != 1 || !reflect.DeepEqual(raw, derived) {
+		t.Errorf("expected derived series to have the labels of %v, got %v", raw, derived)
+	}
+	if expect := `{Device="eth0"}`; len(raw) == 1 && raw[0] != expect {
+		t.Errorf("expected %s, got %s", expect, raw[0])
+	}
+}
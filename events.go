@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const (
+	rdsEventSourceInstance = "DB_INSTANCE"
+	rdsEventSourceCluster  = "DB_CLUSTER"
+)
+
+// resource types of the tag change events of RDS resources
+const (
+	tagEventResourceInstance = "db"
+	tagEventResourceCluster  = "cluster"
+)
+
+type SQSAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// rdsEvent is an RDS event notification, or a tag change event of an RDS
+// resource, as delivered by EventBridge.
+type rdsEvent struct {
+	DetailType string   `json:"detail-type"`
+	Source     string   `json:"source"`
+	Region     string   `json:"region"`
+	Resources  []string `json:"resources"`
+	Detail     struct {
+		EventCategories  []string `json:"EventCategories"`
+		SourceType       string   `json:"SourceType"`
+		SourceArn        string   `json:"SourceArn"`
+		SourceIdentifier string   `json:"SourceIdentifier"`
+		EventID          string   `json:"EventID"`
+		Message          string   `json:"Message"`
+		// fields of tag change events
+		Service      string `json:"service"`
+		ResourceType string `json:"resource-type"`
+	} `json:"detail"`
+}
+
+// exporterResolver returns the exporter of a region, or of the first target
+// when region is empty, as Registry.exporter does.
+type exporterResolver func(region string) (*Exporter, bool)
+
+// EventSubscriber keeps the inventory of the exporters up to date from RDS
+// events delivered to an SQS queue. The exporter of an event is resolved when
+// it is handled, so that events follow the exporters replaced by a reload. The
+// periodic full refresh still runs as a backstop for lost or out-of-order events.
+type EventSubscriber struct {
+	client   SQSAPI
+	queueURL string
+	exporter exporterResolver
+}
+
+// NewEventSubscriber reads the queue with the credentials, endpoints and proxy of target.
+func NewEventSubscriber(ctx context.Context, target Target, queueURL string, exporter exporterResolver) (*EventSubscriber, error) {
+	awsCfg, err := awsConfig(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	client := sqs.NewFromConfig(awsCfg, func(o *sqs.Options) {
+		if target.Endpoints.SQS != "" {
+			o.BaseEndpoint = aws.String(target.Endpoints.SQS)
+		}
+	})
+	return NewEventSubscriberWithClient(client, queueURL, exporter), nil
+}
+
+func NewEventSubscriberWithClient(client SQSAPI, queueURL string, exporter exporterResolver) *EventSubscriber {
+	return &EventSubscriber{
+		client:   client,
+		queueURL: queueURL,
+		exporter: exporter,
+	}
+}
+
+// Run polls the queue until ctx is done.
+func (s *EventSubscriber) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		if err := s.poll(ctx); err != nil {
+			slog.Warn("failed to receive rds events", "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// poll receives one batch of messages and applies them to the inventory.
+// Messages are deleted once handled; messages that fail with a transient error
+// are left in the queue to be redelivered.
+func (s *EventSubscriber) poll(ctx context.Context) error {
+	output, err := s.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(s.queueURL),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     20,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, message := range output.Messages {
+		if message.Body == nil {
+			continue
+		}
+		if err := s.handleMessage(ctx, *message.Body); err != nil {
+			slog.Warn("failed to handle rds event", "message_id", aws.ToString(message.MessageId), "err", err)
+			continue
+		}
+		_, err := s.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(s.queueURL),
+			ReceiptHandle: message.ReceiptHandle,
+		})
+		if err != nil {
+			slog.Warn("failed to delete rds event", "message_id", aws.ToString(message.MessageId), "err", err)
+		}
+	}
+	return nil
+}
+
+func (s *EventSubscriber) handleMessage(ctx context.Context, body string) error {
+	var event rdsEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		// a malformed message will never succeed, drop it
+		slog.Warn("ignoring malformed rds event", "err", err)
+		return nil
+	}
+	switch {
+	case event.Source == "aws.rds" && event.Detail.SourceIdentifier != "":
+		slog.Debug("received rds event", "event_id", event.Detail.EventID, "region", event.Region, "source_type", event.Detail.SourceType, "source_identifier", event.Detail.SourceIdentifier, "categories", event.Detail.EventCategories)
+	case event.Source == "aws.tag" && event.Detail.Service == "rds":
+		slog.Debug("received rds tag change event", "region", event.Region, "resources", event.Resources)
+	default:
+		return nil
+	}
+
+	e, ok := s.exporter(event.Region)
+	if !ok {
+		// the region is not a target, or no longer is since a reload
+		slog.Debug("ignoring rds event of a region that is not a target", "event_id", event.Detail.EventID, "region", event.Region)
+		return nil
+	}
+	if event.Source == "aws.tag" {
+		return s.handleTagEvent(ctx, e, event)
+	}
+	switch event.Detail.SourceType {
+	case rdsEventSourceInstance:
+		return s.handleInstanceEvent(ctx, e, event)
+	case rdsEventSourceCluster:
+		return s.handleClusterEvent(ctx, e, event)
+	}
+	return nil
+}
+
+func (s *EventSubscriber) handleInstanceEvent(ctx context.Context, e *Exporter, event rdsEvent) error {
+	instanceID := event.Detail.SourceIdentifier
+	for _, category := range event.Detail.EventCategories {
+		switch category {
+		case "deletion":
+			e.removeInstance(instanceID)
+			return nil
+		case "creation", "configuration change", "failover":
+			return refreshInstance(ctx, e, instanceID)
+		}
+	}
+	return nil
+}
+
+func (s *EventSubscriber) handleClusterEvent(ctx context.Context, e *Exporter, event rdsEvent) error {
+	clusterID := event.Detail.SourceIdentifier
+	for _, category := range event.Detail.EventCategories {
+		switch category {
+		case "deletion":
+			e.removeCluster(clusterID)
+			return nil
+		case "creation", "configuration change", "failover":
+			return refreshCluster(ctx, e, clusterID)
+		}
+	}
+	return nil
+}
+
+// handleTagEvent refreshes the tags of the resources of a tag change event.
+func (s *EventSubscriber) handleTagEvent(ctx context.Context, e *Exporter, event rdsEvent) error {
+	for _, arn := range event.Resources {
+		// arn:aws:rds:<region>:<account>:<db|cluster>:<identifier>
+		parts := strings.SplitN(arn, ":", 7)
+		if len(parts) < 7 {
+			continue
+		}
+		var err error
+		switch parts[5] {
+		case tagEventResourceInstance:
+			err = refreshInstance(ctx, e, parts[6])
+		case tagEventResourceCluster:
+			err = refreshCluster(ctx, e, parts[6])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshInstance describes an instance, identified by its DBInstanceIdentifier,
+// and stores it into the inventory, or removes it when it no longer exists.
+func refreshInstance(ctx context.Context, e *Exporter, instanceID string) error {
+	output, err := e.rdsClient.DescribeDBInstances(ctx, &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(instanceID),
+	})
+	if err != nil {
+		var nfe *rdsTypes.DBInstanceNotFoundFault
+		if errors.As(err, &nfe) {
+			// deleted or renamed since the event was published
+			e.removeInstance(instanceID)
+			return nil
+		}
+		return err
+	}
+	for _, instance := range output.DBInstances {
+		if err := e.storeInstance(ctx, instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshCluster describes a cluster and stores its members and tags into the
+// inventory, or removes it when it no longer exists.
+func refreshCluster(ctx context.Context, e *Exporter, clusterID string) error {
+	output, err := e.rdsClient.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(clusterID),
+	})
+	if err != nil {
+		var nfe *rdsTypes.DBClusterNotFoundFault
+		if errors.As(err, &nfe) {
+			e.removeCluster(clusterID)
+			return nil
+		}
+		return err
+	}
+	for _, cluster := range output.DBClusters {
+		if err := e.storeCluster(ctx, cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	rds "github.com/aws/aws-sdk-go-v2/service/rds"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type mockedSQS struct {
+	messages []sqsTypes.Message
+	deleted  []string
+}
+
+func (c *mockedSQS) ReceiveMessage(ctx context.Context, input *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	messages := c.messages
+	c.messages = nil
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (c *mockedSQS) DeleteMessage(ctx context.Context, input *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	c.deleted = append(c.deleted, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// eventRDS answers DescribeDBInstances by identifier from a fixed set of instances
+// and falls back to mockedRDS for the full listing.
+type eventRDS struct {
+	mockedRDS
+	instances map[string]rdsTypes.DBInstance
+}
+
+func (c *eventRDS) DescribeDBInstances(ctx context.Context, input *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	if input.DBInstanceIdentifier == nil {
+		return c.mockedRDS.DescribeDBInstances(ctx, input, optFns...)
+	}
+	instance, ok := c.instances[*input.DBInstanceIdentifier]
+	if !ok {
+		return nil, &rdsTypes.DBInstanceNotFoundFault{}
+	}
+	return &rds.DescribeDBInstancesOutput{DBInstances: []rdsTypes.DBInstance{instance}}, nil
+}
+
+func rdsEventMessage(receiptHandle string, sourceType string, sourceID string, category string) sqsTypes.Message {
+	return rdsRegionEventMessage(receiptHandle, "us-east-1", sourceType, sourceID, category)
+}
+
+func rdsRegionEventMessage(receiptHandle string, region string, sourceType string, sourceID string, category string) sqsTypes.Message {
+	return sqsTypes.Message{
+		MessageId:     aws.String(receiptHandle),
+		ReceiptHandle: aws.String(receiptHandle),
+		Body: aws.String(`{
+	"version": "0",
+	"detail-type": "RDS DB Instance Event",
+	"source": "aws.rds",
+	"region": "` + region + `",
+	"detail": {
+		"EventCategories": ["` + category + `"],
+		"SourceType": "` + sourceType + `",
+		"SourceIdentifier": "` + sourceID + `",
+		"EventID": "RDS-EVENT-0000"
+	}
+}`),
+	}
+}
+
+func TestEventSubscriber(t *testing.T) {
+	client := &eventRDS{
+		instances: map[string]rdsTypes.DBInstance{
+			"CCC": {
+				DbiResourceId:        aws.String("db-CCCCCCCCCCCCCCCCCCCCCCCCCC"),
+				DBInstanceIdentifier: aws.String("CCC"),
+				DBInstanceArn:        aws.String("arn:aws:rds:us-east-1:111111111111:db:CCC"),
+			},
+		},
+	}
+	e := NewExporterWithClients(&mockedCloudWatchLogs{}, client, &mockedRGT{})
+	if err := e.collectRdsInfo(context.Background()); err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+
+	queue := &mockedSQS{
+		messages: []sqsTypes.Message{
+			rdsEventMessage("1", "DB_INSTANCE", "CCC", "creation"),
+			rdsEventMessage("2", "DB_CLUSTER", "cluster", "failover"),
+			rdsEventMessage("3", "DB_INSTANCE", "BBB", "deletion"),
+			rdsEventMessage("4", "DB_INSTANCE", "ZZZ", "configuration change"),
+			{MessageId: aws.String("5"), ReceiptHandle: aws.String("5"), Body: aws.String("not json")},
+			rdsRegionEventMessage("6", "eu-west-1", "DB_INSTANCE", "AAA", "deletion"),
+		},
+	}
+	s := NewEventSubscriberWithClient(queue, "https://sqs.us-east-1.amazonaws.com/111111111111/rds-events", func(region string) (*Exporter, bool) {
+		if region != "us-east-1" {
+			return nil, false
+		}
+		return e, true
+	})
+	if err := s.poll(context.Background()); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+
+	if _, ok := e.instanceMap["db-CCCCCCCCCCCCCCCCCCCCCCCCCC"]; !ok {
+		t.Error("expected created instance to be added")
+	}
+	if _, ok := e.tagMap["db-CCCCCCCCCCCCCCCCCCCCCCCCCC"]; !ok {
+		t.Error("expected tags of created instance to be added")
+	}
+	if _, ok := e.instanceMap["db-BBBBBBBBBBBBBBBBBBBBBBBBBB"]; ok {
+		t.Error("expected deleted instance to be removed")
+	}
+	if _, ok := e.memberMap["BBB"]; ok {
+		t.Error("expected cluster member of deleted instance to be removed")
+	}
+	if _, ok := e.instanceMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"]; !ok {
+		t.Error("expected unrelated instance and events of other regions to be kept")
+	}
+	if len(queue.deleted) != 6 {
+		t.Errorf("expected 6 deleted messages, got %d", len(queue.deleted))
+	}
+}
+
+func tagChangeEventMessage(receiptHandle string, resourceType string, arn string) sqsTypes.Message {
+	return sqsTypes.Message{
+		MessageId:     aws.String(receiptHandle),
+		ReceiptHandle: aws.String(receiptHandle),
+		Body: aws.String(`{
+	"version": "0",
+	"detail-type": "Tag Change on Resource",
+	"source": "aws.tag",
+	"region": "us-east-1",
+	"resources": ["` + arn + `"],
+	"detail": {
+		"changed-tag-keys": ["Team"],
+		"service": "rds",
+		"resource-type": "` + resourceType + `",
+		"version": 2
+	}
+}`),
+	}
+}
+
+func TestEventSubscriberClusterEvents(t *testing.T) {
+	e := NewExporterWithClients(&mockedCloudWatchLogs{}, &mockedRDS{}, &mockedRGT{})
+	if err := e.collectRdsInfo(context.Background()); err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+	resolver := func(region string) (*Exporter, bool) {
+		return e, region == "us-east-1"
+	}
+
+	e.clusterTagMap["cluster"] = map[string]string{"Team": "stale"}
+	e.tagMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"] = map[string]string{"Environment": "stale"}
+	queue := &mockedSQS{
+		messages: []sqsTypes.Message{
+			tagChangeEventMessage("1", "cluster", "arn:aws:rds:us-east-1:111111111111:cluster:cluster"),
+			tagChangeEventMessage("2", "db", "arn:aws:rds:us-east-1:111111111111:db:AAA"),
+		},
+	}
+	s := NewEventSubscriberWithClient(queue, "https://sqs.us-east-1.amazonaws.com/111111111111/rds-events", resolver)
+	if err := s.poll(context.Background()); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if got := e.clusterTagMap["cluster"]["Team"]; got != "dba" {
+		t.Errorf("expected cluster tags to be refreshed, got %s", got)
+	}
+	if got := e.tagMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"]["Environment"]; got != "production" {
+		t.Errorf("expected instance tags to be refreshed, got %s", got)
+	}
+
+	queue.messages = []sqsTypes.Message{rdsEventMessage("3", "DB_CLUSTER", "cluster", "deletion")}
+	if err := s.poll(context.Background()); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if _, ok := e.clusterTagMap["cluster"]; ok {
+		t.Error("expected tags of deleted cluster to be removed")
+	}
+	for _, instanceID := range []string{"AAA", "BBB"} {
+		if _, ok := e.memberMap[instanceID]; ok {
+			t.Errorf("expected membership of %s in deleted cluster to be removed", instanceID)
+		}
+	}
+	if len(queue.deleted) != 3 {
+		t.Errorf("expected 3 deleted messages, got %d", len(queue.deleted))
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	metricTypeCounter = "counter"
+	metricTypeGauge   = "gauge"
+	metricTypeUnknown = "unknown"
+)
+
+// metricMetadata describes a metric family in the OpenMetrics exposition.
+// The family name of a counter does not include _total, and the family name
+// of a metric with a unit ends with it.
+type metricMetadata struct {
+	Type string
+	Unit string
+	Help string
+}
+
+var exporterMetadata = map[string]metricMetadata{
+	namespace + "_up":                     {metricTypeGauge, "", "Whether the events of the instance could be exported."},
+	namespace + "_enabled":                {metricTypeGauge, "", "Whether Enhanced Monitoring is enabled on the instance."},
+	namespace + "_interval_seconds":       {metricTypeGauge, "seconds", "MonitoringInterval of the instance."},
+	namespace + "_last_event_age_seconds": {metricTypeGauge, "seconds", "Age of the latest event in the log stream of the instance."},
+
+	namespace + "_exporter_api_requests":                                 {metricTypeCounter, "", "CloudWatch Logs API calls."},
+	namespace + "_exporter_api_throttled":                                {metricTypeCounter, "", "CloudWatch Logs API calls throttled by AWS."},
+	namespace + "_exporter_ratelimit_wait_seconds":                       {metricTypeCounter, "seconds", "Time spent waiting for the CloudWatch Logs rate limiter."},
+	namespace + "_exporter_ratelimit_tps":                                {metricTypeGauge, "", "Current CloudWatch Logs API calls per second allowed by the rate limiter."},
+	namespace + "_exporter_buffer_instances":                             {metricTypeGauge, "", "Instances with buffered samples."},
+	namespace + "_exporter_buffer_samples":                               {metricTypeGauge, "", "Buffered samples."},
+	namespace + "_exporter_buffer_bytes":                                 {metricTypeGauge, "bytes", "Estimated size of the buffered samples."},
+	namespace + "_exporter_buffer_max_bytes":                             {metricTypeGauge, "bytes", "Maximum estimated size of the buffered samples."},
+	namespace + "_exporter_buffer_evicted_samples":                       {metricTypeCounter, "", "Samples evicted from the buffer."},
+	namespace + "_exporter_config_last_reload_successful":                {metricTypeGauge, "", "Whether the last configuration reload succeeded."},
+	namespace + "_exporter_config_last_reload_success_timestamp_seconds": {metricTypeGauge, "seconds", "Timestamp of the last successful configuration reload."},
+}
+
+// deltaFamilies are the families of the delta fields of RDSOSMetrics, which
+// are counters when exported with --metrics.interval-counters.
+var deltaFamilies = func() map[string]bool {
+	families := make(map[string]bool)
+	for name := range deltaFields(RDSOSMetrics{
+		DiskIO:           []DiskIO{{}},
+		PhysicalDeviceIO: []PhysicalDeviceIO{{}},
+	}) {
+		families[namespace+"_"+name[:strings.Index(name, "{")]] = true
+	}
+	return families
+}()
+
+// lookupMetadata returns the metadata of a family. Enhanced Monitoring fields
+// are gauges, as the payload reports their value at the time of the event or
+// over the monitoring interval, unless delta fields are accumulated into counters.
+func lookupMetadata(family string) metricMetadata {
+	if m, ok := exporterMetadata[family]; ok {
+		return m
+	}
+	if strings.HasPrefix(family, namespace+"_") {
+		return metricMetadata{Type: metricTypeGauge}
+	}
+	return metricMetadata{Type: metricTypeUnknown}
+}
+
+// exemplar is attached to a counter in the OpenMetrics exposition.
+type exemplar struct {
+	labels Labels
+	value  float64
+	at     time.Time
+}
+
+// String returns the exemplar to append to a series line, or nothing when it is not set.
+func (e exemplar) String() string {
+	if e.labels == nil {
+		return ""
+	}
+	return fmt.Sprintf(" # {%s} %s %s", e.labels, formatFloat(e.value), formatSeconds(e.at))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatSeconds(t time.Time) string {
+	return formatFloat(float64(t.UnixNano()) / 1e9)
+}
+
+// seriesLine is a line of the text exposition, as built by the exporter:
+//
+//	name{labels} value [timestamp in milliseconds] [# {labels} value timestamp]
+type seriesLine struct {
+	name      string
+	labels    string
+	value     string
+	timestamp string
+	exemplar  string
+}
+
+func parseSeriesLine(line string) (seriesLine, bool) {
+	var s seriesLine
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return s, false
+	}
+	s.name = line[:end]
+	rest := line[end:]
+	if rest[0] == '{' {
+		// label values may contain braces and spaces
+		quoted, escaped := false, false
+		closing := -1
+		for i := 1; i < len(rest) && closing < 0; i++ {
+			switch {
+			case escaped:
+				escaped = false
+			case rest[i] == '\\':
+				escaped = true
+			case rest[i] == '"':
+				quoted = !quoted
+			case rest[i] == '}' && !quoted:
+				closing = i
+			}
+		}
+		if closing < 0 {
+			return s, false
+		}
+		s.labels = rest[1:closing]
+		rest = rest[closing+1:]
+	}
+	if i := strings.Index(rest, " # "); i >= 0 {
+		s.exemplar = rest[i:]
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 2:
+		s.timestamp = fields[1]
+		fallthrough
+	case 1:
+		s.value = fields[0]
+	default:
+		return s, false
+	}
+	return s, true
+}
+
+// family returns the family of a series and the suffix of its name, _total or
+// _created for counters.
+func family(name string) (string, string) {
+	for _, suffix := range []string{"_total", "_created"} {
+		if trimmed := strings.TrimSuffix(name, suffix); trimmed != name && (lookupMetadata(trimmed).Type == metricTypeCounter || deltaFamilies[trimmed]) {
+			return trimmed, suffix
+		}
+	}
+	return name, ""
+}
+
+// formatText returns the series in the text exposition format 0.0.4, which has
+// no _created series nor exemplars.
+func formatText(buf []string) string {
+	lines := make([]string, 0, len(buf))
+	for _, line := range buf {
+		s, ok := parseSeriesLine(line)
+		if !ok {
+			lines = append(lines, line)
+			continue
+		}
+		if _, suffix := family(s.name); suffix == "_created" {
+			continue
+		}
+		if s.exemplar != "" {
+			line = strings.TrimSuffix(line, s.exemplar)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+type metricFamily struct {
+	name     string
+	metadata metricMetadata
+	// metrics are keyed by labels, in the order they first appear
+	order   []string
+	metrics map[string][]seriesLine
+}
+
+// formatOpenMetrics returns the series in the OpenMetrics text format, grouped
+// by family with their metadata, counters named with _total and timestamps in
+// seconds.
+func formatOpenMetrics(buf []string) string {
+	families := make(map[string]*metricFamily)
+	for _, line := range buf {
+		s, ok := parseSeriesLine(line)
+		if !ok {
+			continue
+		}
+		name, suffix := family(s.name)
+		f, ok := families[name]
+		if !ok {
+			f = &metricFamily{name: name, metadata: lookupMetadata(name), metrics: make(map[string][]seriesLine)}
+			if suffix != "" {
+				f.metadata.Type = metricTypeCounter
+			}
+			families[name] = f
+		}
+		if _, ok := f.metrics[s.labels]; !ok {
+			f.order = append(f.order, s.labels)
+		}
+		f.metrics[s.labels] = append(f.metrics[s.labels], s)
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, f.metadata.Type)
+		if f.metadata.Unit != "" {
+			fmt.Fprintf(&sb, "# UNIT %s %s\n", name, f.metadata.Unit)
+		}
+		if f.metadata.Help != "" {
+			fmt.Fprintf(&sb, "# HELP %s %s\n", name, f.metadata.Help)
+		}
+		for _, labels := range f.order {
+			series := f.metrics[labels]
+			// points of a metric are ordered by time, and _created follows _total
+			sort.SliceStable(series, func(i, j int) bool {
+				_, si := family(series[i].name)
+				_, sj := family(series[j].name)
+				if si != sj {
+					return si != "_created"
+				}
+				ti, _ := strconv.ParseInt(series[i].timestamp, 10, 64)
+				tj, _ := strconv.ParseInt(series[j].timestamp, 10, 64)
+				return ti < tj
+			})
+			for i, s := range series {
+				// a metric can not have two points at the same time
+				if i > 0 && s.timestamp != "" && s.timestamp == series[i-1].timestamp && s.name == series[i-1].name {
+					continue
+				}
+				name := s.name
+				if f.metadata.Type == metricTypeCounter && !strings.HasSuffix(name, "_total") && !strings.HasSuffix(name, "_created") {
+					name += "_total"
+				}
+				sb.WriteString(name)
+				if labels != "" {
+					sb.WriteString("{" + labels + "}")
+				}
+				sb.WriteString(" " + s.value)
+				if s.timestamp != "" {
+					if ms, err := strconv.ParseInt(s.timestamp, 10, 64); err == nil {
+						sb.WriteString(" " + formatSeconds(time.UnixMilli(ms)))
+					}
+				}
+				sb.WriteString(s.exemplar + "\n")
+			}
+		}
+	}
+	sb.WriteString("# EOF\n")
+	return sb.String()
+}
+
+// acceptsOpenMetrics reports whether the Accept header prefers OpenMetrics to
+// the text format.
+func acceptsOpenMetrics(accept string) bool {
+	var openMetrics, text float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/openmetrics-text":
+			openMetrics = max(openMetrics, q)
+		case "text/plain", "*/*":
+			text = max(text, q)
+		}
+	}
+	return openMetrics > 0 && openMetrics >= text
+}
+
+// writeMetrics writes the series in the format negotiated with the Accept header of r.
+func writeMetrics(w http.ResponseWriter, r *http.Request, buf []string) {
+	if acceptsOpenMetrics(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+		w.Write([]byte(formatOpenMetrics(buf)))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeText)
+	w.Write([]byte(formatText(buf)))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsOpenMetrics(t *testing.T) {
+	tests := []struct {
+		accept string
+		expect bool
+	}{
+		{"", false},
+		{"text/plain;version=0.0.4;q=1,*/*;q=0.1", false},
+		{"application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", true},
+		{"application/openmetrics-text;version=1.0.0;q=0.2,text/plain;version=0.0.4;q=0.5", false},
+		{"application/openmetrics-text;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsOpenMetrics(tt.accept); got != tt.expect {
+			t.Errorf("expected %v for %q, got %v", tt.expect, tt.accept, got)
+		}
+	}
+}
+
+func TestParseSeriesLine(t *testing.T) {
+	s, ok := parseSeriesLine(`rds_enhanced_monitoring_up{tag_Name="a } b",tag_Quote="\"{"} 1.000000 1486977657000 # {request_id="abc"} 1 1486977657.5`)
+	if !ok {
+		t.Fatal("expected line to be parsed")
+	}
+	expect := seriesLine{
+		name:      "rds_enhanced_monitoring_up",
+		labels:    `tag_Name="a } b",tag_Quote="\"{"`,
+		value:     "1.000000",
+		timestamp: "1486977657000",
+		exemplar:  ` # {request_id="abc"} 1 1486977657.5`,
+	}
+	if expect != s {
+		t.Errorf("expected %+v, got %+v", expect, s)
+	}
+}
+
+var expositionTestSeries = []string{
+	`rds_enhanced_monitoring_Memory_Total{DBInstanceIdentifier="AAA"} 1024.000000 1486977658000`,
+	`rds_enhanced_monitoring_exporter_api_requests_total{api="GetLogEvents"} 3 # {request_id="abc"} 1 1700000000.5`,
+	`rds_enhanced_monitoring_Memory_Total{DBInstanceIdentifier="AAA"} 512.000000 1486977657000`,
+	`rds_enhanced_monitoring_exporter_api_requests_created{api="GetLogEvents"} 1700000000`,
+	`rds_enhanced_monitoring_interval_seconds{DBInstanceIdentifier="AAA"} 1.000000`,
+	`rds_enhanced_monitoring_exporter_buffer_instances 2`,
+	`rds_enhanced_monitoring_Memory_Total{DBInstanceIdentifier="AAA"} 512.000000 1486977657000`,
+}
+
+func TestFormatOpenMetrics(t *testing.T) {
+	expect := `# TYPE rds_enhanced_monitoring_Memory_Total gauge
+rds_enhanced_monitoring_Memory_Total{DBInstanceIdentifier="AAA"} 512.000000 1486977657
+rds_enhanced_monitoring_Memory_Total{DBInstanceIdentifier="AAA"} 1024.000000 1486977658
+# TYPE rds_enhanced_monitoring_exporter_api_requests counter
+# HELP rds_enhanced_monitoring_exporter_api_requests CloudWatch Logs API calls.
+rds_enhanced_monitoring_exporter_api_requests_total{api="GetLogEvents"} 3 # {request_id="abc"} 1 1700000000.5
+rds_enhanced_monitoring_exporter_api_requests_created{api="GetLogEvents"} 1700000000
+# TYPE rds_enhanced_monitoring_exporter_buffer_instances gauge
+# HELP rds_enhanced_monitoring_exporter_buffer_instances Instances with buffered samples.
+rds_enhanced_monitoring_exporter_buffer_instances 2
+# TYPE rds_enhanced_monitoring_interval_seconds gauge
+# UNIT rds_enhanced_monitoring_interval_seconds seconds
+# HELP rds_enhanced_monitoring_interval_seconds MonitoringInterval of the instance.
+rds_enhanced_monitoring_interval_seconds{DBInstanceIdentifier="AAA"} 1.000000
+# EOF
+`
+	if got := formatOpenMetrics(expositionTestSeries); expect != got {
+		t.Errorf("expected %s, got %s", expect, got)
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	got := formatText(expositionTestSeries)
+	if strings.Contains(got, "_created") || strings.Contains(got, "request_id") {
+		t.Errorf("expected no _created series nor exemplars, got %s", got)
+	}
+	if !strings.Contains(got, `rds_enhanced_monitoring_exporter_api_requests_total{api="GetLogEvents"} 3`+"\n") {
+		t.Errorf("expected counter without exemplar, got %s", got)
+	}
+}
+
+func TestExportHandlerOpenMetrics(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n")
+	r := newTestRegistry(t, configFile)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("")
+	e.setLimiters(NewCloudWatchLogsLimiters(100, 100))
+
+	request := httptest.NewRequest("GET", "/metrics?ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA", nil)
+	request.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	request.Header.Set("X-Request-Id", "scrape-1")
+	writer := httptest.NewRecorder()
+	r.exportHandler(writer, request)
+	if got := writer.Header().Get("Content-Type"); got != contentTypeOpenMetrics {
+		t.Errorf("expected %s, got %s", contentTypeOpenMetrics, got)
+	}
+	body := writer.Body.String()
+	for _, expect := range []string{
+		"# TYPE rds_enhanced_monitoring_exporter_api_requests counter\n",
+		`rds_enhanced_monitoring_exporter_api_requests_total{api="GetLogEvents"} 1 # {request_id="scrape-1"} 1 `,
+		"# UNIT rds_enhanced_monitoring_exporter_ratelimit_wait_seconds seconds\n",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("expected %s, got %s", expect, body)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("expected # EOF terminator, got %s", body)
+	}
+
+	writer = httptest.NewRecorder()
+	r.exportHandler(writer, httptest.NewRequest("GET", "/metrics?ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA", nil))
+	if got := writer.Header().Get("Content-Type"); got != contentTypeText {
+		t.Errorf("expected %s, got %s", contentTypeText, got)
+	}
+}
+
+func TestExemplarString(t *testing.T) {
+	if got := (exemplar{}).String(); got != "" {
+		t.Errorf("expected empty exemplar, got %s", got)
+	}
+	ex := exemplar{labels: Labels{"request_id": "abc"}, value: 1, at: time.Unix(1700000000, 500000000)}
+	expect := ` # {request_id="abc"} 1 1700000000.5`
+	if got := ex.String(); expect != got {
+		t.Errorf("expected %s, got %s", expect, got)
+	}
+}
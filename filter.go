@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// tag selector operators, following the Kubernetes label selector syntax
+const (
+	selectorEquals       = "="
+	selectorNotEquals    = "!="
+	selectorIn           = "in"
+	selectorNotIn        = "notin"
+	selectorExists       = "exists"
+	selectorDoesNotExist = "!exists"
+)
+
+var setSelectorPattern = regexp.MustCompile(`^([^\s=!()]+)\s+(in|notin)\s+\(([^()]*)\)$`)
+
+var tagKeyPattern = regexp.MustCompile(`^[^\s=!(),]+$`)
+
+// tagSelector selects instances by one of their tags.
+type tagSelector struct {
+	key    string
+	op     string
+	values map[string]bool
+}
+
+// parseTagSelector parses one of:
+//
+//	key=value, key!=value, key in (v1,v2), key notin (v1,v2), key, !key
+func parseTagSelector(s string) (tagSelector, error) {
+	s = strings.TrimSpace(s)
+	if m := setSelectorPattern.FindStringSubmatch(s); m != nil {
+		values := make(map[string]bool)
+		for _, v := range strings.Split(m[3], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values[v] = true
+			}
+		}
+		if len(values) == 0 {
+			return tagSelector{}, fmt.Errorf("empty set in tag selector %q", s)
+		}
+		return tagSelector{key: m[1], op: m[2], values: values}, nil
+	}
+
+	sel := tagSelector{key: s, op: selectorExists}
+	switch {
+	case strings.HasPrefix(s, "!") && !strings.Contains(s, "="):
+		sel = tagSelector{key: strings.TrimSpace(s[1:]), op: selectorDoesNotExist}
+	case strings.Contains(s, "!="):
+		kv := strings.SplitN(s, "!=", 2)
+		sel = tagSelector{key: strings.TrimSpace(kv[0]), op: selectorNotEquals, values: map[string]bool{strings.TrimSpace(kv[1]): true}}
+	case strings.Contains(s, "="):
+		kv := strings.SplitN(strings.Replace(s, "==", "=", 1), "=", 2)
+		sel = tagSelector{key: strings.TrimSpace(kv[0]), op: selectorEquals, values: map[string]bool{strings.TrimSpace(kv[1]): true}}
+	}
+	if !tagKeyPattern.MatchString(sel.key) {
+		return tagSelector{}, fmt.Errorf("invalid tag selector %q", s)
+	}
+	return sel, nil
+}
+
+func (s tagSelector) match(tags map[string]string) bool {
+	v, ok := tags[s.key]
+	switch s.op {
+	case selectorEquals, selectorIn:
+		return ok && s.values[v]
+	case selectorNotEquals, selectorNotIn:
+		return !ok || !s.values[v]
+	case selectorExists:
+		return ok
+	case selectorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+// instanceFilter is the compiled form of Filters.
+type instanceFilter struct {
+	engines                map[string]bool
+	excludeEngines         map[string]bool
+	instanceClasses        map[string]bool
+	excludeInstanceClasses map[string]bool
+	selectors              []tagSelector
+	identifier             *regexp.Regexp
+	excludeIdentifier      *regexp.Regexp
+}
+
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// compileAnchored compiles a regular expression that has to match the whole string.
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// newInstanceFilter compiles f. It returns nil when f selects every instance.
+func newInstanceFilter(f Filters) (*instanceFilter, error) {
+	if f.empty() {
+		return nil, nil
+	}
+	filter := &instanceFilter{
+		engines:                toSet(f.Engines),
+		excludeEngines:         toSet(f.ExcludeEngines),
+		instanceClasses:        toSet(f.InstanceClasses),
+		excludeInstanceClasses: toSet(f.ExcludeInstanceClasses),
+	}
+	for _, s := range f.TagSelectors {
+		sel, err := parseTagSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		filter.selectors = append(filter.selectors, sel)
+	}
+	var err error
+	if filter.identifier, err = compileAnchored(f.Identifier); err != nil {
+		return nil, fmt.Errorf("identifier: %w", err)
+	}
+	if filter.excludeIdentifier, err = compileAnchored(f.ExcludeIdentifier); err != nil {
+		return nil, fmt.Errorf("exclude_identifier: %w", err)
+	}
+	return filter, nil
+}
+
+// match reports whether an instance with the given effective tags is selected.
+func (f *instanceFilter) match(instance rdsTypes.DBInstance, tags map[string]string) bool {
+	engine := aws.ToString(instance.Engine)
+	if f.engines != nil && !f.engines[engine] || f.excludeEngines[engine] {
+		return false
+	}
+	class := aws.ToString(instance.DBInstanceClass)
+	if f.instanceClasses != nil && !f.instanceClasses[class] || f.excludeInstanceClasses[class] {
+		return false
+	}
+	identifier := aws.ToString(instance.DBInstanceIdentifier)
+	if f.identifier != nil && !f.identifier.MatchString(identifier) {
+		return false
+	}
+	if f.excludeIdentifier != nil && f.excludeIdentifier.MatchString(identifier) {
+		return false
+	}
+	for _, sel := range f.selectors {
+		if !sel.match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// selected reports whether the filter of the exporter selects instance.
+func (e *Exporter) selected(instance rdsTypes.DBInstance) bool {
+	f := e.filter.Load()
+	if f == nil {
+		return true
+	}
+	tags, _ := e.lookupTags(instance)
+	return f.match(instance, tags)
+}
+
+// filtering reports whether the exporter has a filter, in which case instances
+// missing from the inventory are not exported as they can not be matched.
+func (e *Exporter) filtering() bool {
+	return e.filter.Load() != nil
+}
+
+// selectStreams drops the streams of known instances that the filter does not
+// select, before any of them is read. Streams of unknown instances are kept and
+// checked once they are looked up.
+func (e *Exporter) selectStreams(streams []string) []string {
+	if !e.filtering() {
+		return streams
+	}
+	selected := make([]string, 0, len(streams))
+	for _, s := range streams {
+		e.lock.RLock()
+		instance, ok := e.instanceMap[s]
+		e.lock.RUnlock()
+		if !ok || e.selected(instance) {
+			selected = append(selected, s)
+		}
+	}
+	return selected
+}
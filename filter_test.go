@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// monitoredRDS is mockedRDS with Enhanced Monitoring enabled on every instance.
+type monitoredRDS struct {
+	mockedRDS
+}
+
+func (c *monitoredRDS) DescribeDBInstances(ctx context.Context, input *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	output, err := c.mockedRDS.DescribeDBInstances(ctx, input, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range output.DBInstances {
+		output.DBInstances[i].MonitoringInterval = aws.Int32(60)
+	}
+	return output, nil
+}
+
+func TestTagSelector(t *testing.T) {
+	tags := map[string]string{"Environment": "production", "Team": "dba"}
+	tests := []struct {
+		selector string
+		expect   bool
+	}{
+		{"Environment=production", true},
+		{"Environment==production", true},
+		{"Environment = staging", false},
+		{"Environment!=staging", true},
+		{"Owner!=alice", true},
+		{"Environment in (staging, production)", true},
+		{"Environment notin (staging,production)", false},
+		{"Owner notin (alice)", true},
+		{"Team", true},
+		{"Owner", false},
+		{"!Owner", true},
+		{"!Team", false},
+	}
+	for _, tt := range tests {
+		sel, err := parseTagSelector(tt.selector)
+		if err != nil {
+			t.Errorf("%s: %v", tt.selector, err)
+			continue
+		}
+		if got := sel.match(tags); got != tt.expect {
+			t.Errorf("%s: expected %t, got %t", tt.selector, tt.expect, got)
+		}
+	}
+
+	for _, selector := range []string{"", "=production", "Environment in ()", "Environment in (a", "!"} {
+		if _, err := parseTagSelector(selector); err == nil {
+			t.Errorf("expected error for %q", selector)
+		}
+	}
+}
+
+func TestFilterStreams(t *testing.T) {
+	tests := []struct {
+		filters Filters
+		expect  []string
+	}{
+		{Filters{}, []string{"AAA", "BBB"}},
+		{Filters{ExcludeIdentifier: "B+"}, []string{"AAA"}},
+		{Filters{Identifier: "A"}, []string{}},
+		{Filters{Engines: []string{"mysql"}, InstanceClasses: []string{"db.t2.meduim"}}, []string{"AAA", "BBB"}},
+		{Filters{ExcludeEngines: []string{"mysql"}}, []string{}},
+		{Filters{ExcludeInstanceClasses: []string{"db.t2.meduim"}}, []string{}},
+		// Team is inherited from the cluster tags
+		{Filters{TagSelectors: []string{"Environment=production", "Team in (dba,sre)"}}, []string{"AAA", "BBB"}},
+		{Filters{TagSelectors: []string{"!Team"}}, []string{}},
+	}
+	for _, tt := range tests {
+		e := NewExporterWithClients(
+			&failingCloudWatchLogs{},
+			&mockedRDS{},
+			&mockedRGT{},
+		)
+		filter, err := newInstanceFilter(tt.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.filter.Store(filter)
+		outputs := scrapeAll(t, e, nil)
+
+		got := make([]string, 0)
+		for _, line := range outputs {
+			if strings.HasPrefix(line, "rds_enhanced_monitoring_up{") {
+				got = append(got, strings.Split(line, "\"")[1])
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(tt.expect, ",") != strings.Join(got, ",") {
+			t.Errorf("%+v: expected %v, got %v", tt.filters, tt.expect, got)
+		}
+		for _, line := range outputs {
+			if strings.HasPrefix(line, "rds_enhanced_monitoring_enabled{") && len(tt.expect) == 0 {
+				t.Errorf("%+v: expected no inventory series, got %s", tt.filters, line)
+			}
+		}
+	}
+}
+
+func TestSDTargetGroups(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n    filters:\n      exclude_identifier: BBB\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defaultRegion := func(context.Context) (string, error) {
+		return "us-east-1", nil
+	}
+	r := NewRegistry(ctx, configFile, defaultRegion, time.Hour, func(ctx context.Context, target Target) (*Exporter, error) {
+		e := NewExporterWithClients(
+			&mockedCloudWatchLogs{},
+			&monitoredRDS{},
+			&mockedRGT{},
+		)
+		e.region = target.Region
+		return e, nil
+	})
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("")
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.ready.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	groups := r.sdTargetGroups("localhost:9408")
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 target group, got %+v", groups)
+	}
+	expect := map[string]string{
+		"__param_ResourceId":   "db-AAAAAAAAAAAAAAAAAAAAAAAAAA",
+		"__param_region":       "us-east-1",
+		"DBInstanceIdentifier": "AAA",
+	}
+	for k, v := range expect {
+		if groups[0].Labels[k] != v {
+			t.Errorf("expected %s=%s, got %s", k, v, groups[0].Labels[k])
+		}
+	}
+	if groups[0].Targets[0] != "localhost:9408" {
+		t.Errorf("expected %s, got %s", "localhost:9408", groups[0].Targets[0])
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "net/http"
+
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Healthy.\n"))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthyHandler(t *testing.T) {
+	writer := httptest.NewRecorder()
+	healthyHandler(writer, httptest.NewRequest("GET", "/-/healthy", nil))
+	if writer.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, writer.Code)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n")
+	r := newTestRegistry(t, configFile)
+
+	writer := httptest.NewRecorder()
+	r.readyHandler(writer, httptest.NewRequest("GET", "/-/ready", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d before inventory is collected, got %d", http.StatusServiceUnavailable, writer.Code)
+	}
+
+	// the reload starts the inventory refresher of the target
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("")
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.ready.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	writer = httptest.NewRecorder()
+	r.readyHandler(writer, httptest.NewRequest("GET", "/-/ready", nil))
+	if writer.Code != http.StatusOK {
+		t.Errorf("expected %d after inventory is collected, got %d", http.StatusOK, writer.Code)
+	}
+}
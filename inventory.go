@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultInventoryRefreshInterval = 5 * time.Minute
+	defaultNegativeCacheTTL         = 5 * time.Minute
+	// lookupTimeout bounds an on-demand lookup, which outlives the scrape that started it
+	lookupTimeout = 10 * time.Second
+	// on-demand lookups are limited to one per second with a small burst
+	defaultLookupRate  = rate.Limit(1)
+	defaultLookupBurst = 3
+)
+
+// runInventoryRefresher loads the whole inventory immediately and then every
+// interval until ctx is done.
+func (e *Exporter) runInventoryRefresher(ctx context.Context, interval time.Duration) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			err := e.collectRdsInfo(ctx)
+			if err != nil {
+				slog.Warn("failed to collect rds info", "region", e.region, "err", err)
+			}
+			e.pruneNegativeCache()
+			t.Reset(interval)
+		}
+	}
+}
+
+// lookupInstance returns the instance for resourceID. On a cache miss it queries
+// DescribeDBInstances for that single resource so new instances are exported
+// without waiting for the next full refresh. Concurrent misses for the same
+// resource share one API call, misses are remembered for negativeCacheTTL and
+// lookups are rate limited. No lookup is made once ctx is done.
+func (e *Exporter) lookupInstance(ctx context.Context, resourceID string) (rdsTypes.DBInstance, bool) {
+	e.lock.RLock()
+	instance, ok := e.instanceMap[resourceID]
+	notFoundAt, negative := e.negativeCache[resourceID]
+	e.lock.RUnlock()
+	if ok {
+		return instance, true
+	}
+	if negative && time.Since(notFoundAt) < e.negativeCacheTTL {
+		return rdsTypes.DBInstance{}, false
+	}
+	if ctx.Err() != nil {
+		return rdsTypes.DBInstance{}, false
+	}
+
+	v, err, _ := e.lookupGroup.Do(resourceID, func() (interface{}, error) {
+		if !e.lookupLimiter.Allow() {
+			loggerFromContext(ctx).Debug("on-demand instance lookup is rate limited", "stream", resourceID)
+			return nil, nil
+		}
+		// the lookup is shared with the scrapes waiting for it, so that it is not
+		// cancelled with the scrape that happened to start it
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+		defer cancel()
+		return e.describeInstance(ctx, resourceID)
+	})
+	if err != nil {
+		e.deduper.log(ctx, slog.LevelWarn, "lookup:"+resourceID, "failed to look up instance", "stream", resourceID, "err", err)
+		return rdsTypes.DBInstance{}, false
+	}
+	if v == nil {
+		return rdsTypes.DBInstance{}, false
+	}
+	return v.(rdsTypes.DBInstance), true
+}
+
+// pruneNegativeCache drops the misses older than negativeCacheTTL, which are
+// looked up again anyway, so that streams of deleted instances do not pile up.
+func (e *Exporter) pruneNegativeCache() {
+	e.lock.Lock()
+	for resourceID, notFoundAt := range e.negativeCache {
+		if time.Since(notFoundAt) >= e.negativeCacheTTL {
+			delete(e.negativeCache, resourceID)
+		}
+	}
+	e.lock.Unlock()
+}
+
+// describeInstance fetches a single instance, its cluster membership and its tags,
+// and merges them into the inventory. It returns nil when the instance does not exist.
+func (e *Exporter) describeInstance(ctx context.Context, resourceID string) (interface{}, error) {
+	output, err := e.rdsClient.DescribeDBInstances(ctx, &rds.DescribeDBInstancesInput{
+		Filters: []rdsTypes.Filter{
+			{Name: aws.String("dbi-resource-id"), Values: []string{resourceID}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var found *rdsTypes.DBInstance
+	for i, instance := range output.DBInstances {
+		if instance.DbiResourceId != nil && *instance.DbiResourceId == resourceID {
+			found = &output.DBInstances[i]
+		}
+	}
+	if found == nil {
+		e.lock.Lock()
+		e.negativeCache[resourceID] = time.Now()
+		e.lock.Unlock()
+		return nil, nil
+	}
+
+	if err := e.storeInstance(ctx, *found); err != nil {
+		return nil, err
+	}
+	return *found, nil
+}
+
+// storeInstance merges an instance into the inventory together with its
+// cluster membership and tags.
+func (e *Exporter) storeInstance(ctx context.Context, instance rdsTypes.DBInstance) error {
+	var clusters []rdsTypes.DBCluster
+	if instance.DBClusterIdentifier != nil {
+		output, err := e.rdsClient.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{
+			DBClusterIdentifier: instance.DBClusterIdentifier,
+		})
+		if err != nil {
+			return err
+		}
+		clusters = output.DBClusters
+	}
+
+	arns := make([]string, 0)
+	if instance.DBInstanceArn != nil {
+		arns = append(arns, *instance.DBInstanceArn)
+	}
+	for _, cluster := range clusters {
+		if cluster.DBClusterArn != nil {
+			arns = append(arns, *cluster.DBClusterArn)
+		}
+	}
+	tagMap, clusterTagMap, err := e.collectTags(ctx, []rdsTypes.DBInstance{instance}, clusters, arns)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	e.instanceMap[*instance.DbiResourceId] = instance
+	delete(e.negativeCache, *instance.DbiResourceId)
+	for _, cluster := range clusters {
+		for _, member := range cluster.DBClusterMembers {
+			e.memberMap[*member.DBInstanceIdentifier] = member
+		}
+	}
+	e.tagMap[*instance.DbiResourceId] = tagMap[*instance.DbiResourceId]
+	for clusterID, tags := range clusterTagMap {
+		e.clusterTagMap[clusterID] = tags
+	}
+	e.lock.Unlock()
+
+	return nil
+}
+
+// storeCluster merges the members and the tags of a cluster into the inventory.
+func (e *Exporter) storeCluster(ctx context.Context, cluster rdsTypes.DBCluster) error {
+	arns := make([]string, 0)
+	if cluster.DBClusterArn != nil {
+		arns = append(arns, *cluster.DBClusterArn)
+	}
+	_, clusterTagMap, err := e.collectTags(ctx, nil, []rdsTypes.DBCluster{cluster}, arns)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	for _, member := range cluster.DBClusterMembers {
+		e.memberMap[*member.DBInstanceIdentifier] = member
+	}
+	for clusterID, tags := range clusterTagMap {
+		e.clusterTagMap[clusterID] = tags
+	}
+	e.lock.Unlock()
+
+	return nil
+}
+
+// removeCluster drops a cluster, identified by its DBClusterIdentifier, and the
+// membership of its instances from the inventory.
+func (e *Exporter) removeCluster(clusterID string) {
+	e.lock.Lock()
+	delete(e.clusterTagMap, clusterID)
+	for _, instance := range e.instanceMap {
+		if aws.ToString(instance.DBClusterIdentifier) == clusterID && instance.DBInstanceIdentifier != nil {
+			delete(e.memberMap, *instance.DBInstanceIdentifier)
+		}
+	}
+	e.lock.Unlock()
+}
+
+// removeInstance drops an instance, identified by its DBInstanceIdentifier, from the inventory.
+func (e *Exporter) removeInstance(instanceID string) {
+	e.lock.Lock()
+	for resourceID, instance := range e.instanceMap {
+		if instance.DBInstanceIdentifier != nil && *instance.DBInstanceIdentifier == instanceID {
+			delete(e.instanceMap, resourceID)
+			delete(e.tagMap, resourceID)
+		}
+	}
+	delete(e.memberMap, instanceID)
+	e.lock.Unlock()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rds "github.com/aws/aws-sdk-go-v2/service/rds"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// filteringRDS answers DescribeDBInstances honoring the dbi-resource-id filter
+// and counts the calls it receives.
+type filteringRDS struct {
+	mockedRDS
+	calls     atomic.Int32
+	instances []rdsTypes.DBInstance
+	delay     time.Duration
+}
+
+func (c *filteringRDS) DescribeDBInstances(ctx context.Context, input *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	c.calls.Add(1)
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	output := &rds.DescribeDBInstancesOutput{}
+	for _, instance := range c.instances {
+		matched := true
+		for _, f := range input.Filters {
+			if *f.Name == "dbi-resource-id" && f.Values[0] != *instance.DbiResourceId {
+				matched = false
+			}
+		}
+		if matched {
+			output.DBInstances = append(output.DBInstances, instance)
+		}
+	}
+	return output, nil
+}
+
+func newInventoryTestExporter(client *filteringRDS) *Exporter {
+	return NewExporterWithClients(&mockedCloudWatchLogs{}, client, &mockedRGT{})
+}
+
+func TestLookupInstanceOnMiss(t *testing.T) {
+	client := &filteringRDS{
+		instances: []rdsTypes.DBInstance{
+			{
+				DbiResourceId:        aws.String("db-CCCCCCCCCCCCCCCCCCCCCCCCCC"),
+				DBInstanceIdentifier: aws.String("CCC"),
+				DBInstanceArn:        aws.String("arn:aws:rds:us-east-1:111111111111:db:CCC"),
+				DBClusterIdentifier:  aws.String("cluster"),
+			},
+		},
+	}
+	e := newInventoryTestExporter(client)
+
+	instance, ok := e.lookupInstance(context.Background(), "db-CCCCCCCCCCCCCCCCCCCCCCCCCC")
+	if !ok {
+		t.Fatal("expected instance to be found")
+	}
+	if *instance.DBInstanceIdentifier != "CCC" {
+		t.Errorf("expected CCC, got %s", *instance.DBInstanceIdentifier)
+	}
+	if _, ok := e.memberMap["AAA"]; !ok {
+		t.Error("expected cluster members to be cached")
+	}
+	if _, ok := e.tagMap["db-CCCCCCCCCCCCCCCCCCCCCCCCCC"]; !ok {
+		t.Error("expected tags to be cached")
+	}
+
+	// a second lookup is served from the cache
+	e.lookupInstance(context.Background(), "db-CCCCCCCCCCCCCCCCCCCCCCCCCC")
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+}
+
+func TestLookupInstanceNegativeCache(t *testing.T) {
+	client := &filteringRDS{}
+	e := newInventoryTestExporter(client)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := e.lookupInstance(context.Background(), "db-DDDDDDDDDDDDDDDDDDDDDDDDDD"); ok {
+			t.Fatal("expected instance not to be found")
+		}
+	}
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+
+	// an expired entry triggers a new lookup
+	e.negativeCache["db-DDDDDDDDDDDDDDDDDDDDDDDDDD"] = time.Now().Add(-2 * e.negativeCacheTTL)
+	e.lookupInstance(context.Background(), "db-DDDDDDDDDDDDDDDDDDDDDDDDDD")
+	if got := client.calls.Load(); got != 2 {
+		t.Errorf("expected 2 calls, got %d", got)
+	}
+}
+
+func TestLookupInstanceSingleFlight(t *testing.T) {
+	client := &filteringRDS{delay: 100 * time.Millisecond}
+	e := newInventoryTestExporter(client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.lookupInstance(context.Background(), "db-EEEEEEEEEEEEEEEEEEEEEEEEEE")
+		}()
+	}
+	wg.Wait()
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+}
+
+func TestLookupInstanceRateLimit(t *testing.T) {
+	client := &filteringRDS{}
+	e := newInventoryTestExporter(client)
+
+	for i := 0; i < defaultLookupBurst+2; i++ {
+		e.lookupInstance(context.Background(), "db-missing-"+string(rune('a'+i)))
+	}
+	if got := client.calls.Load(); got != defaultLookupBurst {
+		t.Errorf("expected %d calls, got %d", defaultLookupBurst, got)
+	}
+}
+
+func TestLookupInstanceDoneContext(t *testing.T) {
+	client := &filteringRDS{}
+	e := newInventoryTestExporter(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := e.lookupInstance(ctx, "db-FFFFFFFFFFFFFFFFFFFFFFFFFF"); ok {
+		t.Fatal("expected instance not to be found")
+	}
+	if got := client.calls.Load(); got != 0 {
+		t.Errorf("expected no call with a done context, got %d", got)
+	}
+}
+
+func TestLookupInstanceOutlivesCaller(t *testing.T) {
+	client := &filteringRDS{
+		delay: 100 * time.Millisecond,
+		instances: []rdsTypes.DBInstance{
+			{
+				DbiResourceId:        aws.String("db-GGGGGGGGGGGGGGGGGGGGGGGGGG"),
+				DBInstanceIdentifier: aws.String("GGG"),
+			},
+		},
+	}
+	e := newInventoryTestExporter(client)
+
+	// the scrape starting the lookup times out, the one sharing it does not
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.lookupInstance(ctx, "db-GGGGGGGGGGGGGGGGGGGGGGGGGG")
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := e.lookupInstance(context.Background(), "db-GGGGGGGGGGGGGGGGGGGGGGGGGG"); !ok {
+		t.Error("expected the shared lookup to complete")
+	}
+	wg.Wait()
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+}
+
+func TestPruneNegativeCache(t *testing.T) {
+	e := newInventoryTestExporter(&filteringRDS{})
+	e.negativeCache["db-expired"] = time.Now().Add(-2 * e.negativeCacheTTL)
+	e.negativeCache["db-recent"] = time.Now()
+
+	e.pruneNegativeCache()
+	if _, ok := e.negativeCache["db-expired"]; ok {
+		t.Error("expected expired entry to be pruned")
+	}
+	if _, ok := e.negativeCache["db-recent"]; !ok {
+		t.Error("expected recent entry to be kept")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+
+	// repeated warnings with the same key are logged at most once per window
+	defaultLogDedupWindow = 10 * time.Minute
+)
+
+// newLogger returns a logger writing to w at level, in logfmt or JSON.
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case logFormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext returns the scrape-scoped logger of ctx, or the default logger.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the ID of the scrape of ctx.
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// requestID returns the X-Request-Id of r, or a random ID when it is not set.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logDeduper suppresses repeated log records with the same key within window,
+// so that a problem seen on every scrape, such as a missing instance, is not
+// logged for every stream of every scrape.
+type logDeduper struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	loggedAt   time.Time
+	suppressed int
+}
+
+func newLogDeduper(window time.Duration) *logDeduper {
+	return &logDeduper{
+		window: window,
+		seen:   make(map[string]*dedupEntry),
+	}
+}
+
+// allow reports whether a record with key should be logged now, and how many
+// records with that key were suppressed since it was last logged.
+func (d *logDeduper) allow(key string, now time.Time) (bool, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.seen[key]
+	if ok && now.Sub(entry.loggedAt) < d.window {
+		entry.suppressed++
+		return false, 0
+	}
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	d.seen[key] = &dedupEntry{loggedAt: now}
+	// forget keys that have not been logged for a while, so the map does not grow with every resource ever seen
+	for k, v := range d.seen {
+		if now.Sub(v.loggedAt) >= 2*d.window {
+			delete(d.seen, k)
+		}
+	}
+	return true, suppressed
+}
+
+// log logs a record at level unless a record with the same key was logged within the window.
+func (d *logDeduper) log(ctx context.Context, level slog.Level, key string, msg string, args ...any) {
+	ok, suppressed := d.allow(key, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	loggerFromContext(ctx).Log(ctx, level, msg, args...)
+}
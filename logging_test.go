@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger(&out, "warn", logFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("dropped")
+	logger.Warn("kept", "stream", "db-AAAAAAAAAAAAAAAAAAAAAAAAAA")
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q", out.String())
+	}
+	if record["msg"] != "kept" {
+		t.Errorf("expected %s, got %v", "kept", record["msg"])
+	}
+
+	for _, tt := range [][2]string{{"verbose", logFormatLogfmt}, {"info", "xml"}} {
+		if _, err := newLogger(&out, tt[0], tt[1]); err == nil {
+			t.Errorf("expected error for level %s and format %s", tt[0], tt[1])
+		}
+	}
+}
+
+func TestLogDeduper(t *testing.T) {
+	d := newLogDeduper(time.Minute)
+	now := time.Now()
+	if ok, _ := d.allow("a", now); !ok {
+		t.Error("expected first record to be logged")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := d.allow("a", now.Add(time.Second)); ok {
+			t.Error("expected repeated record to be suppressed")
+		}
+	}
+	if ok, _ := d.allow("b", now.Add(time.Second)); !ok {
+		t.Error("expected record with another key to be logged")
+	}
+	ok, suppressed := d.allow("a", now.Add(time.Minute))
+	if !ok {
+		t.Error("expected record to be logged after the window")
+	}
+	if suppressed != 3 {
+		t.Errorf("expected %d, got %d", 3, suppressed)
+	}
+}
+
+func TestScrapeLogAttributes(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger(&out, "info", logFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(defaultLogger)
+
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	e.region = "ap-northeast-1"
+	e.lookupLimiter.SetBurst(0)
+	for i := 0; i < 2; i++ {
+		writer := httptest.NewRecorder()
+		request := &http.Request{
+			URL: &url.URL{
+				RawQuery: "ResourceId=db-ZZZZZZZZZZZZZZZZZZZZZZZZZZ",
+			},
+			Header:     http.Header{"X-Request-Id": []string{"abc"}},
+			RemoteAddr: "127.0.0.1:9408",
+		}
+		e.exportHandler(writer, request.WithContext(context.Background()))
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected the missing instance to be logged once, got %q", out.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"remote_addr": "127.0.0.1",
+		"resource_id": "db-ZZZZZZZZZZZZZZZZZZZZZZZZZZ",
+		"region":      "ap-northeast-1",
+		"request_id":  "abc",
+	}
+	for k, v := range expect {
+		if record[k] != v {
+			t.Errorf("expected %s=%s, got %v", k, v, record[k])
+		}
+	}
+}
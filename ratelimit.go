@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultGetLogEventsTPS       = 10
+	defaultDescribeLogStreamsTPS = 5
+
+	throttleMaxRetries = 3
+	throttleBaseDelay  = 200 * time.Millisecond
+	// the rate never drops below this fraction of the configured TPS
+	throttleMinRateRatio = 0.1
+	// after a throttle, the rate recovers by this fraction of the configured TPS per second
+	throttleRecoveryRatio = 0.05
+)
+
+func isThrottling(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// apiLimiter is a token bucket for one API. Its rate is halved whenever AWS
+// throttles a call and recovers gradually to the configured TPS afterwards.
+type apiLimiter struct {
+	name    string
+	limiter *rate.Limiter
+	maxRate rate.Limit
+	minRate rate.Limit
+
+	// created is when the counters started
+	created time.Time
+
+	mu          sync.Mutex
+	lastAdjust  time.Time
+	requests    uint64
+	throttled   uint64
+	waitSeconds float64
+	// the latest scrape that called the API and that was throttled
+	requestsExemplar  exemplar
+	throttledExemplar exemplar
+}
+
+func newAPILimiter(name string, tps float64) *apiLimiter {
+	burst := int(tps)
+	if burst < 1 {
+		burst = 1
+	}
+	return &apiLimiter{
+		name:    name,
+		limiter: rate.NewLimiter(rate.Limit(tps), burst),
+		maxRate: rate.Limit(tps),
+		minRate: rate.Limit(tps * throttleMinRateRatio),
+		created: time.Now(),
+	}
+}
+
+// requestExemplar returns an exemplar carrying the request ID of the scrape of ctx, if any.
+func requestExemplar(ctx context.Context) (exemplar, bool) {
+	id, ok := requestIDFromContext(ctx)
+	if !ok {
+		return exemplar{}, false
+	}
+	return exemplar{labels: Labels{"request_id": id}, value: 1, at: time.Now()}, true
+}
+
+// wait blocks until a token is available and records the time spent waiting.
+// Only the calls issued after a token is obtained are counted as requests.
+func (l *apiLimiter) wait(ctx context.Context) error {
+	l.recover()
+	start := time.Now()
+	err := l.limiter.Wait(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waitSeconds += time.Since(start).Seconds()
+	if err != nil {
+		return err
+	}
+	l.requests++
+	if ex, ok := requestExemplar(ctx); ok {
+		l.requestsExemplar = ex
+	}
+	return nil
+}
+
+func (l *apiLimiter) onThrottle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.throttled++
+	l.limiter.SetLimit(max(l.limiter.Limit()/2, l.minRate))
+	l.lastAdjust = time.Now()
+}
+
+// recover raises the rate in proportion to the time elapsed since the last adjustment.
+func (l *apiLimiter) recover() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.limiter.Limit()
+	if current >= l.maxRate {
+		return
+	}
+	now := time.Now()
+	step := rate.Limit(now.Sub(l.lastAdjust).Seconds()) * l.maxRate * throttleRecoveryRatio
+	l.limiter.SetLimit(min(current+step, l.maxRate))
+	l.lastAdjust = now
+}
+
+// limitedCall runs fn once a token is available and retries it with exponential backoff
+// while AWS throttles it. The SDK retryer does not retry throttled calls itself,
+// see withoutThrottleRetries, so that every attempt goes through the limiter.
+func limitedCall[T any](ctx context.Context, l *apiLimiter, fn func() (T, error)) (T, error) {
+	var zero T
+	for attempt := 0; ; attempt++ {
+		if err := l.wait(ctx); err != nil {
+			return zero, err
+		}
+		output, err := fn()
+		if err == nil || !isThrottling(err) || attempt >= throttleMaxRetries {
+			return output, err
+		}
+		l.onThrottle()
+		if ex, ok := requestExemplar(ctx); ok {
+			l.mu.Lock()
+			l.throttledExemplar = ex
+			l.mu.Unlock()
+		}
+
+		delay := throttleBaseDelay << attempt
+		delay += time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// throttleRetryDisabled is an SDK retryer that leaves throttled calls to limitedCall.
+type throttleRetryDisabled struct {
+	aws.Retryer
+}
+
+func (r throttleRetryDisabled) IsErrorRetryable(err error) bool {
+	return !isThrottling(err) && r.Retryer.IsErrorRetryable(err)
+}
+
+func (r throttleRetryDisabled) GetAttemptToken(ctx context.Context) (func(error) error, error) {
+	if v2, ok := r.Retryer.(aws.RetryerV2); ok {
+		return v2.GetAttemptToken(ctx)
+	}
+	return r.Retryer.GetInitialToken(), nil
+}
+
+// withoutThrottleRetries keeps the SDK retries of a call for other errors than
+// throttling, which limitedCall backs off from while reducing the rate.
+func withoutThrottleRetries(o *cloudwatchlogs.Options) {
+	if o.Retryer != nil {
+		o.Retryer = throttleRetryDisabled{o.Retryer}
+	}
+}
+
+// CloudWatchLogsLimiters are shared by every exporter, as the CloudWatch Logs
+// quota is shared by every scrape.
+type CloudWatchLogsLimiters struct {
+	describeLogStreams *apiLimiter
+	getLogEvents       *apiLimiter
+}
+
+func NewCloudWatchLogsLimiters(describeLogStreamsTPS float64, getLogEventsTPS float64) *CloudWatchLogsLimiters {
+	return &CloudWatchLogsLimiters{
+		describeLogStreams: newAPILimiter("DescribeLogStreams", describeLogStreamsTPS),
+		getLogEvents:       newAPILimiter("GetLogEvents", getLogEventsTPS),
+	}
+}
+
+// metrics returns the limiter metrics in the text exposition format.
+func (l *CloudWatchLogsLimiters) metrics() []string {
+	buf := make([]string, 0)
+	for _, limiter := range []*apiLimiter{l.describeLogStreams, l.getLogEvents} {
+		limiter.mu.Lock()
+		label := Labels{"api": limiter.name}
+		created := formatSeconds(limiter.created)
+		buf = append(buf,
+			fmt.Sprintf("%s_exporter_api_requests_total{%s} %d%s", namespace, label, limiter.requests, limiter.requestsExemplar),
+			fmt.Sprintf("%s_exporter_api_requests_created{%s} %s", namespace, label, created),
+			fmt.Sprintf("%s_exporter_api_throttled_total{%s} %d%s", namespace, label, limiter.throttled, limiter.throttledExemplar),
+			fmt.Sprintf("%s_exporter_api_throttled_created{%s} %s", namespace, label, created),
+			fmt.Sprintf("%s_exporter_ratelimit_wait_seconds_total{%s} %f", namespace, label, limiter.waitSeconds),
+			fmt.Sprintf("%s_exporter_ratelimit_wait_seconds_created{%s} %s", namespace, label, created),
+			fmt.Sprintf("%s_exporter_ratelimit_tps{%s} %f", namespace, label, float64(limiter.limiter.Limit())),
+		)
+		limiter.mu.Unlock()
+	}
+	return buf
+}
+
+// setLimiters routes the CloudWatch Logs calls of the exporter through limiters.
+func (e *Exporter) setLimiters(limiters *CloudWatchLogsLimiters) {
+	e.cwLogsClient = newRateLimitedCloudWatchLogs(e.cwLogsClient, limiters)
+	e.limiters = limiters
+}
+
+// rateLimitedCloudWatchLogs applies CloudWatchLogsLimiters to a CloudWatchLogsAPI.
+type rateLimitedCloudWatchLogs struct {
+	client   CloudWatchLogsAPI
+	limiters *CloudWatchLogsLimiters
+}
+
+func newRateLimitedCloudWatchLogs(client CloudWatchLogsAPI, limiters *CloudWatchLogsLimiters) *rateLimitedCloudWatchLogs {
+	return &rateLimitedCloudWatchLogs{
+		client:   client,
+		limiters: limiters,
+	}
+}
+
+func (c *rateLimitedCloudWatchLogs) DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	optFns = append(optFns[:len(optFns):len(optFns)], withoutThrottleRetries)
+	return limitedCall(ctx, c.limiters.describeLogStreams, func() (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		return c.client.DescribeLogStreams(ctx, input, optFns...)
+	})
+}
+
+func (c *rateLimitedCloudWatchLogs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	optFns = append(optFns[:len(optFns):len(optFns)], withoutThrottleRetries)
+	return limitedCall(ctx, c.limiters.getLogEvents, func() (*cloudwatchlogs.GetLogEventsOutput, error) {
+		return c.client.GetLogEvents(ctx, input, optFns...)
+	})
+}
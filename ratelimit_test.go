@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/smithy-go"
+)
+
+// throttlingCloudWatchLogs throttles the first throttles GetLogEvents calls.
+type throttlingCloudWatchLogs struct {
+	mockedCloudWatchLogs
+	throttles int32
+	calls     atomic.Int32
+}
+
+func (c *throttlingCloudWatchLogs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	if c.calls.Add(1) <= c.throttles {
+		return nil, &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	}
+	return c.mockedCloudWatchLogs.GetLogEvents(ctx, input, optFns...)
+}
+
+func getLogEventsInput() *cloudwatchlogs.GetLogEventsInput {
+	return &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String("RDSOSMetrics"),
+		LogStreamName: aws.String("db-AAAAAAAAAAAAAAAAAAAAAAAAAA"),
+	}
+}
+
+func TestRateLimitedThrottlingBackoff(t *testing.T) {
+	mock := &throttlingCloudWatchLogs{throttles: 2}
+	limiters := NewCloudWatchLogsLimiters(10, 10)
+	client := newRateLimitedCloudWatchLogs(mock, limiters)
+
+	_, err := client.GetLogEvents(context.Background(), getLogEventsInput())
+	if err != nil {
+		t.Fatalf("expected throttled call to be retried, got %v", err)
+	}
+	if got := mock.calls.Load(); got != 3 {
+		t.Errorf("expected 3 calls, got %d", got)
+	}
+	if got := limiters.getLogEvents.throttled; got != 2 {
+		t.Errorf("expected 2 throttles, got %d", got)
+	}
+	if got := float64(limiters.getLogEvents.limiter.Limit()); got >= 10 {
+		t.Errorf("expected rate to be reduced, got %f", got)
+	}
+	if got := float64(limiters.describeLogStreams.limiter.Limit()); got != 10 {
+		t.Errorf("expected DescribeLogStreams rate to be unchanged, got %f", got)
+	}
+}
+
+func TestRateLimitedThrottlingGivesUp(t *testing.T) {
+	mock := &throttlingCloudWatchLogs{throttles: 100}
+	client := newRateLimitedCloudWatchLogs(mock, NewCloudWatchLogsLimiters(100, 100))
+
+	_, err := client.GetLogEvents(context.Background(), getLogEventsInput())
+	if !isThrottling(err) {
+		t.Fatalf("expected throttling error, got %v", err)
+	}
+	if got := mock.calls.Load(); got != throttleMaxRetries+1 {
+		t.Errorf("expected %d calls, got %d", throttleMaxRetries+1, got)
+	}
+}
+
+func TestRateLimitedWaitTime(t *testing.T) {
+	limiters := NewCloudWatchLogsLimiters(20, 20)
+	client := newRateLimitedCloudWatchLogs(&mockedCloudWatchLogs{}, limiters)
+
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		if _, err := client.GetLogEvents(context.Background(), getLogEventsInput()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected calls beyond the burst to be delayed, took %s", elapsed)
+	}
+	if limiters.getLogEvents.waitSeconds <= 0 {
+		t.Error("expected wait time to be recorded")
+	}
+
+	var found bool
+	for _, line := range limiters.metrics() {
+		if strings.HasPrefix(line, `rds_enhanced_monitoring_exporter_api_requests_total{api="GetLogEvents"} 25`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected request count in %v", limiters.metrics())
+	}
+}
+
+func TestLimiterRecovery(t *testing.T) {
+	l := newAPILimiter("GetLogEvents", 10)
+	l.onThrottle()
+	if got := float64(l.limiter.Limit()); got != 5 {
+		t.Fatalf("expected rate 5, got %f", got)
+	}
+	l.lastAdjust = time.Now().Add(-time.Minute)
+	l.recover()
+	if got := float64(l.limiter.Limit()); got != 10 {
+		t.Errorf("expected rate to recover to 10, got %f", got)
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := newAPILimiter("GetLogEvents", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err == nil {
+		t.Fatal("expected error when the context is cancelled")
+	}
+	if l.requests != 0 {
+		t.Errorf("expected no request to be counted, got %d", l.requests)
+	}
+}
+
+func TestWithoutThrottleRetries(t *testing.T) {
+	o := cloudwatchlogs.Options{Retryer: retry.NewStandard()}
+	withoutThrottleRetries(&o)
+
+	if o.Retryer.IsErrorRetryable(&smithy.GenericAPIError{Code: "ThrottlingException"}) {
+		t.Error("expected throttling to be left to the limiter")
+	}
+	if !o.Retryer.IsErrorRetryable(&smithy.GenericAPIError{Code: "RequestTimeoutException"}) {
+		t.Error("expected other transient errors to be retried by the SDK")
+	}
+}
@@ -9,25 +9,30 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	cloudwatchlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
 	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
 	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
-	"golang.org/x/sync/errgroup"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
 const (
 	namespace = "rds_enhanced_monitoring"
+
+	defaultScrapeTimeoutOffset = 500 * time.Millisecond
 )
 
 type CloudWatchLogsAPI interface {
@@ -45,41 +50,146 @@ type ResourceGroupsTaggingAPI interface {
 }
 
 type Exporter struct {
+	region       string
 	cwLogsClient CloudWatchLogsAPI
 	rdsClient    RDSAPI
 	rgtClient    ResourceGroupsTaggingAPI
+	stsClient    STSAPI
+	credentials  aws.CredentialsProvider
 	lock         sync.RWMutex
 	instanceMap  map[string]rdsTypes.DBInstance
 	memberMap    map[string]rdsTypes.DBClusterMember
 	tagMap       map[string]map[string]string
-	lastUpdated  map[string]map[string]int64
+	// clusterTagMap is keyed by DBClusterIdentifier
+	clusterTagMap map[string]map[string]string
+	cursorLock    sync.Mutex
+	lastUpdated   map[string]map[string]int64
+
+	negativeCache    map[string]time.Time
+	negativeCacheTTL time.Duration
+	lookupGroup      singleflight.Group
+	lookupLimiter    *rate.Limiter
+
+	derivedMetrics bool
+	tagPrecedence  string
+	tagSource      string
+	tagAPIDenied   atomic.Bool
+
+	scrapeTimeoutOffset time.Duration
+	limiters            *CloudWatchLogsLimiters
+
+	streamSource     string
+	streamCacheTTL   time.Duration
+	streamLock       sync.Mutex
+	streams          []string
+	streamsFetchedAt time.Time
+	streamGroup      singleflight.Group
+	lastEvents       map[string]int64
+
+	// filter selects the instances to export, nil selects all of them
+	filter atomic.Pointer[instanceFilter]
+
+	// ready is set once the inventory has been collected successfully
+	ready atomic.Bool
+	// refreshedAt is when the whole inventory was last collected
+	refreshedAt time.Time
+
+	// deduper rate limits warnings repeated on every scrape
+	deduper *logDeduper
+	// scrapes are the latest scrapes of every scraper, for the status page
+	scrapes *scrapeHistory
+
+	// samples buffers the decoded events, nil when disabled
+	samples            *SampleBuffer
+	samplePollInterval time.Duration
+
+	// intervalCounters exports the delta fields as counters accumulated per stream
+	intervalCounters bool
+	counterLock      sync.Mutex
+	counters         map[string]*counterState
 }
 
-func NewExporter(ctx context.Context, region string) (*Exporter, error) {
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+func NewExporter(ctx context.Context, target Target) (*Exporter, error) {
+	awsCfg, err := awsConfig(ctx, target)
 	if err != nil {
 		return nil, err
 	}
+	cwLogsClient := cloudwatchlogs.NewFromConfig(awsCfg, func(o *cloudwatchlogs.Options) {
+		if target.Endpoints.Logs != "" {
+			o.BaseEndpoint = aws.String(target.Endpoints.Logs)
+		}
+	})
+	rdsClient := rds.NewFromConfig(awsCfg, func(o *rds.Options) {
+		if target.Endpoints.RDS != "" {
+			o.BaseEndpoint = aws.String(target.Endpoints.RDS)
+		}
+	})
+	rgtClient := resourcegroupstaggingapi.NewFromConfig(awsCfg, func(o *resourcegroupstaggingapi.Options) {
+		if target.Endpoints.Tagging != "" {
+			o.BaseEndpoint = aws.String(target.Endpoints.Tagging)
+		}
+	})
 	return &Exporter{
-		cwLogsClient: cloudwatchlogs.NewFromConfig(awsCfg),
-		rdsClient:    rds.NewFromConfig(awsCfg),
-		rgtClient:    resourcegroupstaggingapi.NewFromConfig(awsCfg),
-		instanceMap:  make(map[string]rdsTypes.DBInstance),
-		memberMap:    make(map[string]rdsTypes.DBClusterMember),
-		tagMap:       make(map[string]map[string]string),
-		lastUpdated:  make(map[string]map[string]int64),
+		region:        target.Region,
+		cwLogsClient:  cwLogsClient,
+		rdsClient:     rdsClient,
+		rgtClient:     rgtClient,
+		stsClient:     sts.NewFromConfig(awsCfg, stsEndpoint(target)),
+		credentials:   awsCfg.Credentials,
+		instanceMap:   make(map[string]rdsTypes.DBInstance),
+		memberMap:     make(map[string]rdsTypes.DBClusterMember),
+		tagMap:        make(map[string]map[string]string),
+		clusterTagMap: make(map[string]map[string]string),
+		lastUpdated:   make(map[string]map[string]int64),
+
+		negativeCache:    make(map[string]time.Time),
+		negativeCacheTTL: defaultNegativeCacheTTL,
+		lookupLimiter:    rate.NewLimiter(defaultLookupRate, defaultLookupBurst),
+
+		tagPrecedence: tagPrecedenceInstance,
+		tagSource:     tagSourceBoth,
+
+		scrapeTimeoutOffset: defaultScrapeTimeoutOffset,
+
+		streamSource:   streamSourceLogs,
+		streamCacheTTL: defaultStreamCacheTTL,
+		lastEvents:     make(map[string]int64),
+
+		deduper: newLogDeduper(defaultLogDedupWindow),
+		scrapes: newScrapeHistory(),
+
+		counters: make(map[string]*counterState),
 	}, nil
 }
 
 func NewExporterWithClients(cw CloudWatchLogsAPI, rds RDSAPI, rgt ResourceGroupsTaggingAPI) *Exporter {
 	return &Exporter{
-		cwLogsClient: cw,
-		rdsClient:    rds,
-		rgtClient:    rgt,
-		instanceMap:  make(map[string]rdsTypes.DBInstance),
-		memberMap:    make(map[string]rdsTypes.DBClusterMember),
-		tagMap:       make(map[string]map[string]string),
-		lastUpdated:  make(map[string]map[string]int64),
+		cwLogsClient:  cw,
+		rdsClient:     rds,
+		rgtClient:     rgt,
+		instanceMap:   make(map[string]rdsTypes.DBInstance),
+		memberMap:     make(map[string]rdsTypes.DBClusterMember),
+		tagMap:        make(map[string]map[string]string),
+		clusterTagMap: make(map[string]map[string]string),
+		lastUpdated:   make(map[string]map[string]int64),
+
+		negativeCache:    make(map[string]time.Time),
+		negativeCacheTTL: defaultNegativeCacheTTL,
+		lookupLimiter:    rate.NewLimiter(defaultLookupRate, defaultLookupBurst),
+
+		tagPrecedence: tagPrecedenceInstance,
+		tagSource:     tagSourceBoth,
+
+		scrapeTimeoutOffset: defaultScrapeTimeoutOffset,
+
+		streamSource:   streamSourceLogs,
+		streamCacheTTL: defaultStreamCacheTTL,
+		lastEvents:     make(map[string]int64),
+
+		deduper: newLogDeduper(defaultLogDedupWindow),
+		scrapes: newScrapeHistory(),
+
+		counters: make(map[string]*counterState),
 	}
 }
 
@@ -108,53 +218,54 @@ func (e *Exporter) collectRdsInfo(ctx context.Context) error {
 		params.Marker = resp.Marker
 	}
 
-	var resources resourcegroupstaggingapi.GetResourcesOutput
-	rgtPaginator := resourcegroupstaggingapi.NewGetResourcesPaginator(
-		e.rgtClient,
-		&resourcegroupstaggingapi.GetResourcesInput{
-			ResourceTypeFilters: []string{"rds:db"},
-			TagsPerPage:         aws.Int32(500),
-		},
-	)
-	for rgtPaginator.HasMorePages() {
-		output, err := rgtPaginator.NextPage(ctx)
-		if err != nil {
-			return err
-		}
-		resources.ResourceTagMappingList = append(resources.ResourceTagMappingList, output.ResourceTagMappingList...)
-	}
-
-	e.lock.Lock()
+	// build new maps so that deleted or renamed resources are dropped
+	instanceMap := make(map[string]rdsTypes.DBInstance)
 	for _, instance := range dbInstances.DBInstances {
-		e.instanceMap[*instance.DbiResourceId] = instance
+		instanceMap[*instance.DbiResourceId] = instance
 	}
+	memberMap := make(map[string]rdsTypes.DBClusterMember)
 	for _, cluster := range dbClusters.DBClusters {
 		for _, member := range cluster.DBClusterMembers {
-			e.memberMap[*member.DBInstanceIdentifier] = member
+			memberMap[*member.DBInstanceIdentifier] = member
 		}
 	}
-	for _, mapping := range resources.ResourceTagMappingList {
-		instanceID := strings.Split(*mapping.ResourceARN, ":")[6]
-		e.tagMap[instanceID] = make(map[string]string)
-		for _, tag := range mapping.Tags {
-			e.tagMap[instanceID][*tag.Key] = *tag.Value
-		}
+
+	tagMap, clusterTagMap, err := e.collectTags(ctx, dbInstances.DBInstances, dbClusters.DBClusters, nil)
+	if err != nil {
+		return err
 	}
+
+	e.lock.Lock()
+	e.instanceMap = instanceMap
+	e.memberMap = memberMap
+	e.tagMap = tagMap
+	e.clusterTagMap = clusterTagMap
+	e.refreshedAt = time.Now()
 	e.lock.Unlock()
+	e.ready.Store(true)
 
 	return nil
 }
 
 func outputMetrics(buf []string, m interface{}, format string, prefix string, label Labels) []string {
+	walkMetrics(m, prefix, label, func(name string, kind string, label Labels, value float64) {
+		buf = append(buf, fmt.Sprintf(format, name, label, value))
+	})
+	return buf
+}
+
+// walkMetrics calls fn for every numeric field of m with its series name, its
+// kind and its labels, which include the device of the slice it belongs to.
+func walkMetrics(m interface{}, prefix string, label Labels, fn func(name string, kind string, label Labels, value float64)) {
 	mv := reflect.ValueOf(m)
 	if mv.Kind() != reflect.Struct {
-		return buf
+		return
 	}
 	for i := 0; i < mv.NumField(); i++ {
 		field := mv.Field(i)
 		switch field.Kind() {
 		case reflect.Float64:
-			buf = append(buf, fmt.Sprintf(format, prefix+mv.Type().Field(i).Name, label, field.Interface()))
+			fn(prefix+mv.Type().Field(i).Name, fieldKind(mv.Type().Field(i)), label, field.Float())
 		case reflect.String:
 			// ignore
 		case reflect.Slice:
@@ -175,241 +286,391 @@ func outputMetrics(buf []string, m interface{}, format string, prefix string, la
 					copiedLabel["MountPoint"] = slice.FieldByName("MountPoint").String()
 					copiedLabel["Name"] = slice.FieldByName("Name").String()
 				case "Network":
-					copiedLabel["Device"] = slice.FieldByName("Device").String()
+					// Network has no Device field, its interface is the device
+					copiedLabel["Device"] = slice.FieldByName("Interface").String()
 				}
-				buf = append(buf, outputMetrics(make([]string, 0), slice.Interface(), format, prefix+sliceType+"_", copiedLabel)...)
+				walkMetrics(slice.Interface(), prefix+sliceType+"_", copiedLabel, fn)
 			}
 		default:
-			buf = append(buf, outputMetrics(make([]string, 0), field.Interface(), format, prefix+field.Type().Name()+"_", label)...)
+			walkMetrics(field.Interface(), prefix+field.Type().Name()+"_", label, fn)
 		}
 	}
-	return buf
 }
 
-func (e *Exporter) exportHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	remoteAddr := strings.Split(r.RemoteAddr, ":")[0]
+// instanceLabels returns the labels requested by labels[] for an instance.
+func (e *Exporter) instanceLabels(instance rdsTypes.DBInstance, targetLabels []string) Labels {
+	label, _ := e.resolveLabels(instance, targetLabels)
+	return label
+}
+
+// resolveLabels returns the labels requested by labels[] for an instance, and
+// the reason why each requested label that can not be resolved is missing.
+// Fields missing from the instance leave their label out rather than failing.
+func (e *Exporter) resolveLabels(instance rdsTypes.DBInstance, targetLabels []string) (Labels, map[string]string) {
+	label := Labels{}
+	failed := make(map[string]string)
+	set := func(l string, name string, field string, v *string) {
+		if v == nil {
+			failed[l] = field + " is not set"
+			return
+		}
+		label[name] = *v
+	}
+	engine := aws.ToString(instance.Engine)
+	e.lock.RLock()
+	member, isMember := e.memberMap[aws.ToString(instance.DBInstanceIdentifier)]
+	e.lock.RUnlock()
+	isMember = isMember && member.IsClusterWriter != nil
+
+	targetTags := make(map[string]string)
+	targetClusterTags := make(map[string]string)
+	for _, l := range targetLabels {
+		switch l {
+		case "DBInstanceIdentifier":
+			set(l, l, l, instance.DBInstanceIdentifier)
+		case "DBClusterIdentifier":
+			switch engine {
+			case "aurora", "aurora-mysql":
+				set(l, l, l, instance.DBClusterIdentifier)
+			default:
+				failed[l] = "not applicable to the engine"
+			}
+		case "DBInstanceClass":
+			set(l, l, l, instance.DBInstanceClass)
+		case "StorageType":
+			set(l, l, l, instance.StorageType)
+		case "AvailabilityZone":
+			set(l, l, l, instance.AvailabilityZone)
+		case "DBSubnetGroup.VpcId":
+			if instance.DBSubnetGroup == nil {
+				failed[l] = "DBSubnetGroup is not set"
+				break
+			}
+			set(l, "VpcId", l, instance.DBSubnetGroup.VpcId)
+		case "Engine":
+			set(l, l, l, instance.Engine)
+		case "EngineVersion":
+			set(l, l, l, instance.EngineVersion)
+		case "IsClusterWriter":
+			if !isMember {
+				failed[l] = "not a cluster member"
+				break
+			}
+			label["IsClusterWriter"] = strconv.FormatBool(*member.IsClusterWriter)
+		case "RDSInstanceType":
+			switch engine {
+			case "aurora", "aurora-mysql":
+				if !isMember {
+					failed[l] = "not a cluster member"
+				} else if *member.IsClusterWriter {
+					label["RDSInstanceType"] = "writer"
+				} else {
+					label["RDSInstanceType"] = "reader"
+				}
+			case "mysql":
+				if instance.ReadReplicaSourceDBInstanceIdentifier == nil {
+					label["RDSInstanceType"] = "master"
+				} else {
+					label["RDSInstanceType"] = "slave"
+				}
+			default:
+				failed[l] = "not applicable to the engine"
+			}
+		default:
+			if strings.HasPrefix(l, "tag_") {
+				targetTags[l[4:]] = l
+			} else if strings.HasPrefix(l, "cluster_tag_") {
+				targetClusterTags[l[12:]] = l
+			} else {
+				failed[l] = "unknown label"
+			}
+		}
+	}
+	tags, clusterTags := e.lookupTags(instance)
+	for k, l := range targetTags {
+		if v, ok := tags[k]; ok {
+			label[l] = v
+		} else {
+			failed[l] = "tag is not set"
+		}
+	}
+	for k, l := range targetClusterTags {
+		if v, ok := clusterTags[k]; ok {
+			label[l] = v
+		} else {
+			failed[l] = "tag is not set"
+		}
+	}
+	return label, failed
+}
+
+// exportStream reads the events of a log stream published since the last scrape of
+// remoteAddr and returns them as series. On error the series read so far are returned.
+func (e *Exporter) exportStream(ctx context.Context, remoteAddr string, s string, label Labels) ([]string, error) {
+	buf := make([]string, 0)
+	input := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String("RDSOSMetrics"),
+		LogStreamName: aws.String(s),
+		StartFromHead: aws.Bool(false),
+		Limit:         aws.Int32(3),
+	}
+	if lastUpdated, ok := e.cursor(remoteAddr, s); ok {
+		input.StartTime = aws.Int64(lastUpdated + 1)
+	}
+	events, err := e.cwLogsClient.GetLogEvents(ctx, input)
+	if err != nil {
+		return buf, err
+	}
+
+	if len(events.Events) == 0 {
+		loggerFromContext(ctx).Debug("GetLogEvents response is empty", "stream", s)
+		return buf, nil
+	}
+
+	for _, event := range events.Events {
+		// decoded into a new value each time, as buffered samples keep their slices
+		var m RDSOSMetrics
+		err = json.Unmarshal([]byte(*event.Message), &m)
+		if err != nil {
+			return buf, err
+		}
+		if e.samples != nil {
+			e.samples.add(s, *event.Timestamp, m, len(*event.Message))
+		}
+
+		e.advanceCursor(remoteAddr, s, *event.Timestamp)
+		e.recordLastEvent(s, *event.Timestamp)
+		format := seriesFormat(*event.Timestamp)
+
+		if e.intervalCounters {
+			buf = outputGaugeMetrics(buf, m, format, label)
+		} else {
+			buf = outputMetrics(buf, m, format, "", label)
+		}
+		if e.derivedMetrics {
+			buf = outputDerivedMetrics(buf, m, format, label)
+		}
+	}
+
+	return buf, nil
+}
+
+// cursor returns the timestamp of the last event of stream s exported to remoteAddr.
+func (e *Exporter) cursor(remoteAddr string, s string) (int64, bool) {
+	e.cursorLock.Lock()
+	defer e.cursorLock.Unlock()
+	lastUpdated, ok := e.lastUpdated[remoteAddr][s]
+	return lastUpdated, ok
+}
+
+func (e *Exporter) advanceCursor(remoteAddr string, s string, timestamp int64) {
+	e.cursorLock.Lock()
+	defer e.cursorLock.Unlock()
 	if _, ok := e.lastUpdated[remoteAddr]; !ok {
 		e.lastUpdated[remoteAddr] = make(map[string]int64)
 	}
+	if timestamp > e.lastUpdated[remoteAddr][s] {
+		e.lastUpdated[remoteAddr][s] = timestamp
+	}
+}
+
+// scrapeContext derives the context of a scrape from the timeout Prometheus sends in
+// X-Prometheus-Scrape-Timeout-Seconds, minus offset to leave time to write the response.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return context.WithCancel(r.Context())
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		loggerFromContext(r.Context()).Warn("invalid X-Prometheus-Scrape-Timeout-Seconds", "value", v)
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+func (e *Exporter) exportHandler(w http.ResponseWriter, r *http.Request) {
+	buf, err := e.collect(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMetrics(w, r, buf)
+}
+
+// collect scrapes the log streams requested by r and returns the series.
+func (e *Exporter) collect(r *http.Request) (buf []string, err error) {
+	remoteAddr := strings.Split(r.RemoteAddr, ":")[0]
 	targetResourceId := r.URL.Query().Get("ResourceId")
+	id := requestID(r)
+	logger := slog.Default().With(
+		"remote_addr", remoteAddr,
+		"resource_id", targetResourceId,
+		"region", e.region,
+		"request_id", id,
+	)
+	ctx, cancel := scrapeContext(r.WithContext(withRequestID(withLogger(r.Context(), logger), id)), e.scrapeTimeoutOffset)
+	defer cancel()
+
+	start := time.Now()
+	var failed atomic.Int64
+	defer func() {
+		e.scrapes.record(scrapeRecord{
+			Scraper:       remoteAddr,
+			ResourceID:    targetResourceId,
+			Start:         start,
+			Duration:      time.Since(start),
+			Series:        len(buf),
+			FailedStreams: int(failed.Load()),
+			Error:         scrapeError(err, errors.Is(ctx.Err(), context.DeadlineExceeded)),
+		})
+	}()
 
 	targetLabels := r.URL.Query()["labels[]"]
 
-	targetStreams := make([]string, 1)
+	var targetStreams []string
 	if len(targetResourceId) == 0 {
-		paginator := cloudwatchlogs.NewDescribeLogStreamsPaginator(
-			e.cwLogsClient,
-			&cloudwatchlogs.DescribeLogStreamsInput{
-				LogGroupName: aws.String("RDSOSMetrics"),
-				OrderBy:      "LastEventTime",
-				Descending:   aws.Bool(true),
-			},
-		)
-		for paginator.HasMorePages() {
-			output, err := paginator.NextPage(ctx)
-			if err != nil {
-				var rnfe *cloudwatchlogsTypes.ResourceNotFoundException
-				if errors.As(err, &rnfe) {
-					slog.Info("RDSOSMetrics is not found")
-					return
-				}
-				slog.Error("error: calling DescribeLogStreams is failed")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			for _, stream := range output.LogStreams {
-				if time.Unix(*stream.LastEventTimestamp/1000, 0).After(time.Now().Add(-1 * time.Hour)) {
-					targetStreams = append(targetStreams, *stream.LogStreamName)
-				}
+		targetStreams, err = e.activeStreams(ctx)
+		if err != nil {
+			var rnfe *cloudwatchlogsTypes.ResourceNotFoundException
+			if errors.As(err, &rnfe) {
+				logger.Info("RDSOSMetrics is not found")
+				return nil, nil
 			}
+			logger.Error("calling DescribeLogStreams is failed", "err", err)
+			return nil, err
 		}
 	} else {
-		targetStreams[0] = targetResourceId
+		targetStreams = []string{targetResourceId}
 	}
 
-	buf := make([]string, 0)
-	var mu sync.RWMutex
-	eg := errgroup.Group{}
+	targetStreams = e.selectStreams(targetStreams)
+	if e.intervalCounters {
+		e.pruneCounters(time.Now())
+	}
+
+	// an up series per stream reports whether its events could be exported
+	upFormat := namespace + "_%s{%s} %f"
+	buf = make([]string, 0)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 	ch := make(chan int, 5)
 	for _, stream := range targetStreams {
-		ch <- 1
+		select {
+		case ch <- 1:
+		case <-ctx.Done():
+		}
 		s := stream
-		eg.Go(func() error {
-			waitTime := time.Now().Add(1 * time.Second)
-			defer func() {
-				now := time.Now()
-				if now.Before(waitTime) {
-					time.Sleep(waitTime.Sub(now))
-				}
-				<-ch
-			}()
-			e.lock.RLock()
-			instance, ok := e.instanceMap[s]
-			if !ok {
-				e.lock.RUnlock()
-				slog.Error(fmt.Sprintf("error: %s is not found in instanceMap", s))
-				return nil
+		if ctx.Err() != nil {
+			// the scrape deadline is reached, report the remaining streams as failed,
+			// labeled from the inventory as no lookup is made with the expired ctx
+			label := Labels{"ResourceId": s}
+			instance, ok := e.lookupInstance(ctx, s)
+			if ok && !e.selected(instance) || !ok && e.filtering() {
+				continue
 			}
-			e.lock.RUnlock()
-
-			input := &cloudwatchlogs.GetLogEventsInput{
-				LogGroupName:  aws.String("RDSOSMetrics"),
-				LogStreamName: aws.String(s),
-				StartFromHead: aws.Bool(false),
-				Limit:         aws.Int32(3),
+			if ok {
+				label = e.instanceLabels(instance, targetLabels)
 			}
-			if _, ok := e.lastUpdated[remoteAddr][s]; ok {
-				input.StartTime = aws.Int64(e.lastUpdated[remoteAddr][s] + 1)
+			failed.Add(1)
+			mu.Lock()
+			buf = append(buf, fmt.Sprintf(upFormat, "up", label, 0.0))
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-ch }()
+			instance, ok := e.lookupInstance(ctx, s)
+			if ok && !e.selected(instance) {
+				return
 			}
-			events, err := e.cwLogsClient.GetLogEvents(ctx, input)
-			if err != nil {
-				return err
+			if !ok && e.filtering() {
+				e.deduper.log(ctx, slog.LevelDebug, "not-found-filtered:"+s, "skipping stream of an instance not found in the inventory, as the filters can not be matched", "stream", s)
+				return
 			}
-
-			if len(events.Events) == 0 {
-				slog.Info("GetLogEvents response is empty")
-				return nil
+			if !ok {
+				e.deduper.log(ctx, slog.LevelWarn, "not-found:"+s, "instance is not found in the inventory", "stream", s)
+				failed.Add(1)
+				mu.Lock()
+				buf = append(buf, fmt.Sprintf(upFormat, "up", Labels{"ResourceId": s}, 0.0))
+				mu.Unlock()
+				return
 			}
 
-			var m RDSOSMetrics
-			for _, event := range events.Events {
-				err = json.Unmarshal([]byte(*event.Message), &m)
-				if err != nil {
-					return err
-				}
-
-				timestamp := *event.Timestamp / 1000
-				if *event.Timestamp > e.lastUpdated[remoteAddr][s] {
-					e.lastUpdated[remoteAddr][s] = *event.Timestamp
-				}
-				format := namespace + "_%s{%s} %f " + strconv.FormatInt(timestamp, 10) + "000"
-
-				label := Labels{}
-				targetTags := make(map[string]bool)
-				for _, l := range targetLabels {
-					switch l {
-					case "DBInstanceIdentifier":
-						label["DBInstanceIdentifier"] = *instance.DBInstanceIdentifier
-					case "DBClusterIdentifier":
-						switch *instance.Engine {
-						case "aurora":
-							fallthrough
-						case "aurora-mysql":
-							label["DBClusterIdentifier"] = *instance.DBClusterIdentifier
-						}
-					case "DBInstanceClass":
-						label["DBInstanceClass"] = *instance.DBInstanceClass
-					case "StorageType":
-						label["StorageType"] = *instance.StorageType
-					case "AvailabilityZone":
-						label["AvailabilityZone"] = *instance.AvailabilityZone
-					case "DBSubnetGroup.VpcId":
-						label["VpcId"] = *instance.DBSubnetGroup.VpcId
-					case "Engine":
-						label["Engine"] = *instance.Engine
-					case "EngineVersion":
-						label["EngineVersion"] = *instance.EngineVersion
-					case "IsClusterWriter":
-						e.lock.RLock()
-						if member, ok := e.memberMap[*instance.DBInstanceIdentifier]; ok {
-							if *member.IsClusterWriter {
-								label["IsClusterWriter"] = "true"
-							} else {
-								label["IsClusterWriter"] = "false"
-							}
-						}
-						e.lock.RUnlock()
-					case "RDSInstanceType":
-						e.lock.RLock()
-						switch *instance.Engine {
-						case "aurora":
-							fallthrough
-						case "aurora-mysql":
-							if member, ok := e.memberMap[*instance.DBInstanceIdentifier]; ok {
-								if *member.IsClusterWriter {
-									label["RDSInstanceType"] = "writer"
-								} else {
-									label["RDSInstanceType"] = "reader"
-								}
-							}
-						case "mysql":
-							if instance.ReadReplicaSourceDBInstanceIdentifier == nil {
-								label["RDSInstanceType"] = "master"
-							} else {
-								label["RDSInstanceType"] = "slave"
-
-							}
-						}
-						e.lock.RUnlock()
-					default:
-						if strings.Index(l, "tag_") == 0 {
-							targetTags[l[4:]] = true
-						}
-					}
-				}
-				e.lock.RLock()
-				for k, v := range e.tagMap[*instance.DBInstanceIdentifier] {
-					if targetTags[k] {
-						label["tag_"+k] = v
+			label := e.instanceLabels(instance, targetLabels)
+			lines, err := e.exportStream(ctx, remoteAddr, s, label)
+			up := 1.0
+			if err != nil {
+				e.deduper.log(ctx, slog.LevelWarn, "export:"+s, "failed to export stream", "stream", s, "err", err)
+				failed.Add(1)
+				up = 0
+			}
+			if e.intervalCounters {
+				if err == nil {
+					if err := e.accumulateStream(ctx, s); err != nil {
+						e.deduper.log(ctx, slog.LevelWarn, "counters:"+s, "failed to accumulate counters", "stream", s, "err", err)
+						failed.Add(1)
+						up = 0
 					}
 				}
-				e.lock.RUnlock()
-				mu.Lock()
-				buf = append(buf, outputMetrics(make([]string, 0), m, format, "", label)...)
-				mu.Unlock()
+				lines = append(lines, e.counterSeries(s, label)...)
 			}
-
-			return nil
-		})
-	}
-
-	if err := eg.Wait(); err != nil {
-		slog.Error("failed to wait", "err", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("error: %s", err)))
-		return
+			mu.Lock()
+			buf = append(buf, lines...)
+			buf = append(buf, fmt.Sprintf(upFormat, "up", label, up))
+			mu.Unlock()
+		}()
 	}
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-	w.Write([]byte(strings.Join(buf, "\n")))
-}
-
-var regionCache = ""
+	wg.Wait()
 
-func GetDefaultRegion() (string, error) {
-	var region string
-
-	if regionCache != "" {
-		return regionCache, nil
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Warn("scrape deadline is reached, returning partial results")
 	}
-
-	ctx := context.TODO()
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryMaxAttempts(0))
-	if err != nil {
-		return "", err
+	buf = append(buf, e.inventoryMetrics(targetResourceId, targetLabels)...)
+	if e.limiters != nil {
+		buf = append(buf, e.limiters.metrics()...)
 	}
-
-	client := imds.NewFromConfig(cfg)
-	response, err := client.GetRegion(ctx, &imds.GetRegionInput{})
-	if err != nil {
-		region = os.Getenv("AWS_REGION")
-		if region == "" {
-			region = "us-east-1"
-		}
-	} else {
-		region = response.Region
-		if region != "" {
-			regionCache = region
-		}
+	if e.samples != nil {
+		buf = append(buf, e.samples.metrics()...)
 	}
-
-	return region, nil
+	return buf, nil
 }
 
 type flagConfig struct {
 	listenAddress string
+	webConfigFile string
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	shutdownGrace time.Duration
+	timeoutOffset time.Duration
+	logEventsTPS  float64
+	logStreamsTPS float64
+	streamSource  string
+	streamTTL     time.Duration
 	metricsPath   string
 	configFile    string
+	derived       bool
+	counters      bool
+	refreshPeriod time.Duration
+	sqsQueueURL   string
+	tagPrecedence string
+	tagSource     string
+	logLevel      string
+	logFormat     string
+	checkConfig   bool
+	stateFile     string
+	stateFlush    time.Duration
+	bufRetention  time.Duration
+	bufMaxSamples int
+	bufMaxBytes   int64
+	bufPoll       time.Duration
 }
 
 func main() {
@@ -417,62 +678,203 @@ func main() {
 	flag.StringVar(&cfg.listenAddress, "web.listen-address", ":9408", "Address to listen on for web endpoints.")
 	flag.StringVar(&cfg.metricsPath, "web.telemetry-path", "/metrics", "Path under which to expose metrics.")
 	flag.StringVar(&cfg.configFile, "config.file", "./rds_enhanced_monitoring_exporter.yml", "Configuration file path.")
+	flag.BoolVar(&cfg.derived, "metrics.derived", false, "Also export metrics derived from the raw Enhanced Monitoring sample.")
+	flag.BoolVar(&cfg.counters, "metrics.interval-counters", false, "Export the fields totalled over the monitoring interval, such as DiskIO_ReadKb, as counters accumulated per instance instead of gauges.")
+	flag.DurationVar(&cfg.refreshPeriod, "inventory.refresh-interval", defaultInventoryRefreshInterval, "Interval between full refreshes of the RDS inventory.")
+	flag.StringVar(&cfg.sqsQueueURL, "inventory.sqs-queue-url", "", "URL of an SQS queue receiving RDS events from EventBridge. When set, the inventory is also updated from events.")
+	flag.StringVar(&cfg.tagPrecedence, "tags.precedence", tagPrecedenceInstance, "Which tag wins when an instance and its cluster define the same key: instance or cluster.")
+	flag.StringVar(&cfg.tagSource, "tags.source", tagSourceBoth, "Where tags are read from: instance (TagList of DescribeDBInstances/DescribeDBClusters), api (Resource Groups Tagging API) or both.")
+	flag.StringVar(&cfg.webConfigFile, "web.config.file", "", "Path to configuration file that can enable TLS or authentication.")
+	flag.DurationVar(&cfg.readTimeout, "web.read-timeout", 10*time.Second, "Maximum duration for reading an entire request.")
+	flag.DurationVar(&cfg.writeTimeout, "web.write-timeout", 2*time.Minute, "Maximum duration before timing out writes of a response. Must be longer than the scrape timeout.")
+	flag.DurationVar(&cfg.idleTimeout, "web.idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive connection.")
+	flag.DurationVar(&cfg.shutdownGrace, "web.shutdown-timeout", 30*time.Second, "Maximum duration to wait for in-flight requests on shutdown.")
+	flag.DurationVar(&cfg.timeoutOffset, "web.scrape-timeout-offset", defaultScrapeTimeoutOffset, "Offset to subtract from the scrape timeout sent by Prometheus, to leave time for writing the response.")
+	flag.Float64Var(&cfg.logEventsTPS, "cloudwatchlogs.get-log-events-tps", defaultGetLogEventsTPS, "Maximum GetLogEvents calls per second, shared by all scrapes and regions.")
+	flag.Float64Var(&cfg.logStreamsTPS, "cloudwatchlogs.describe-log-streams-tps", defaultDescribeLogStreamsTPS, "Maximum DescribeLogStreams calls per second, shared by all scrapes and regions.")
+	flag.StringVar(&cfg.streamSource, "streams.source", streamSourceLogs, "How the log streams to scrape are listed: logs (DescribeLogStreams) or inventory (instances with MonitoringInterval > 0).")
+	flag.DurationVar(&cfg.streamTTL, "streams.cache-ttl", defaultStreamCacheTTL, "How long the DescribeLogStreams result is reused by all scrapes.")
+	flag.StringVar(&cfg.logLevel, "log.level", "info", "Only log messages with the given severity or above: debug, info, warn or error.")
+	flag.StringVar(&cfg.logFormat, "log.format", logFormatLogfmt, "Output format of log messages: logfmt or json.")
+	flag.StringVar(&cfg.stateFile, "state.file", "", "File the scrape cursors are persisted to, so that a restart does not export events again. Disabled when empty.")
+	flag.DurationVar(&cfg.stateFlush, "state.flush-interval", defaultStateFlushInterval, "Interval between saves of the state file. It is also saved on shutdown.")
+	flag.DurationVar(&cfg.bufRetention, "buffer.retention", 0, "How long decoded samples are kept in memory for /api/v1/instances/{resourceId}/samples. Disabled when 0.")
+	flag.IntVar(&cfg.bufMaxSamples, "buffer.max-samples", defaultBufferMaxSamples, "Maximum number of samples kept per instance.")
+	flag.Int64Var(&cfg.bufMaxBytes, "buffer.max-bytes", defaultBufferMaxBytes, "Maximum estimated size of all buffered samples. The oldest samples are evicted beyond it.")
+	flag.DurationVar(&cfg.bufPoll, "buffer.poll-interval", defaultBufferPollInterval, "Interval between reads of every event of the active streams into the buffer. When 0, only the events read by scrapes are buffered.")
+	flag.BoolVar(&cfg.checkConfig, "check-config", false, "Validate the configuration file, print the normalized configuration and exit.")
 	flag.Parse()
 
-	exporterCfg, err := LoadConfig(cfg.configFile)
+	logger, err := newLogger(os.Stderr, cfg.logLevel, cfg.logFormat)
 	if err != nil {
-		slog.Error("failed to load config", "err", err)
+		slog.Error("failed to configure logging", "err", err)
 		os.Exit(1)
 	}
+	slog.SetDefault(logger)
 
-	// set default region
-	region, err := GetDefaultRegion()
-	if err != nil {
-		slog.Error("failed to get default region", "err", err)
+	if cfg.checkConfig {
+		if err := checkConfig(os.Stdout, cfg.configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	switch cfg.streamSource {
+	case streamSourceLogs, streamSourceInventory:
+	default:
+		slog.Error("invalid stream source", "source", cfg.streamSource)
 		os.Exit(1)
 	}
-	if len(exporterCfg.Targets) == 0 {
-		exporterCfg.Targets = make([]Target, 1)
-		exporterCfg.Targets[0] = Target{Region: region}
+	if cfg.tagPrecedence != tagPrecedenceInstance && cfg.tagPrecedence != tagPrecedenceCluster {
+		slog.Error("invalid tag precedence", "precedence", cfg.tagPrecedence)
+		os.Exit(1)
 	}
-	ctx := context.TODO()
-	exporter, err := NewExporter(ctx, region)
-	if err != nil {
-		slog.Error("failed to new exporter", "err", err)
+	switch cfg.tagSource {
+	case tagSourceInstance, tagSourceAPI, tagSourceBoth:
+	default:
+		slog.Error("invalid tag source", "source", cfg.tagSource)
 		os.Exit(1)
 	}
 
-	err = exporter.collectRdsInfo(ctx)
-	if err != nil {
-		slog.Warn("failed to collect rds info", "err", err)
+	if cfg.refreshPeriod <= 0 {
+		slog.Error("invalid inventory refresh interval", "interval", cfg.refreshPeriod)
+		os.Exit(1)
+	}
+	// a rate of 0 would fail every call after the first and never recover
+	if cfg.logEventsTPS <= 0 || cfg.logStreamsTPS <= 0 {
+		slog.Error("invalid CloudWatch Logs rate", "get_log_events_tps", cfg.logEventsTPS, "describe_log_streams_tps", cfg.logStreamsTPS)
+		os.Exit(1)
+	}
+	if cfg.stateFile != "" && cfg.stateFlush <= 0 {
+		slog.Error("invalid state flush interval", "interval", cfg.stateFlush)
+		os.Exit(1)
+	}
+
+	if cfg.bufRetention > 0 && cfg.bufMaxSamples <= 0 {
+		slog.Error("invalid buffer size", "max_samples", cfg.bufMaxSamples)
+		os.Exit(1)
+	}
+
+	// cancelled on SIGTERM/SIGINT, which stops the inventory loop and the server
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	limiters := NewCloudWatchLogsLimiters(cfg.logStreamsTPS, cfg.logEventsTPS)
+	var samples *SampleBuffer
+	if cfg.bufRetention > 0 {
+		samples = NewSampleBuffer(cfg.bufRetention, cfg.bufMaxSamples, cfg.bufMaxBytes)
+	}
+	registry := NewRegistry(ctx, cfg.configFile, newRegionResolver().resolve, cfg.refreshPeriod, func(ctx context.Context, target Target) (*Exporter, error) {
+		exporter, err := NewExporter(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		exporter.derivedMetrics = cfg.derived
+		exporter.intervalCounters = cfg.counters
+		exporter.scrapeTimeoutOffset = cfg.timeoutOffset
+		exporter.streamSource = cfg.streamSource
+		exporter.streamCacheTTL = cfg.streamTTL
+		exporter.setLimiters(limiters)
+		exporter.tagPrecedence = cfg.tagPrecedence
+		exporter.tagSource = cfg.tagSource
+		exporter.samples = samples
+		exporter.samplePollInterval = cfg.bufPoll
+		// the identity is only informational, it does not hold up the exporter
+		go exporter.logIdentity(ctx)
+		return exporter, nil
+	})
+	var store *StateStore
+	if cfg.stateFile != "" {
+		store = NewStateStore(cfg.stateFile)
+		saved, err := store.Load()
+		if err != nil {
+			slog.Error("failed to load state", "file", cfg.stateFile, "err", err)
+			os.Exit(1)
+		}
+		registry.restoreState(saved)
+	}
+	if err := registry.Reload(); err != nil {
+		slog.Error("failed to load config", "err", err)
+		os.Exit(1)
 	}
+	if store != nil {
+		go registry.runStateFlusher(ctx, store, cfg.stateFlush)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		t := time.NewTimer(0)
-		defer t.Stop()
-		for range t.C {
-			t.Reset(5 * time.Minute)
-			err = exporter.collectRdsInfo(ctx)
-			if err != nil {
-				slog.Warn("failed to collect rds info", "err", err)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := registry.Reload(); err != nil {
+					slog.Error("failed to reload config", "err", err)
+				}
 			}
 		}
 	}()
 
-	http.HandleFunc(cfg.metricsPath, exporter.exportHandler)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>RDS Enhanced Monitoring Exporter</title></head>
-			<body>
-			<h1>RDS Enhanced Monitoring Exporter</h1>
-			<p><a href="` + cfg.metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
-	})
+	if cfg.sqsQueueURL != "" {
+		// the queue is read with the AWS config of the first target, and events
+		// update the inventory of the target of their region
+		target, ok := registry.target("")
+		if !ok {
+			slog.Error("no target to receive rds events with")
+			os.Exit(1)
+		}
+		subscriber, err := NewEventSubscriber(ctx, target, cfg.sqsQueueURL, registry.exporter)
+		if err != nil {
+			slog.Error("failed to new event subscriber", "err", err)
+			os.Exit(1)
+		}
+		go subscriber.Run(ctx)
+	}
+
+	http.HandleFunc(cfg.metricsPath, registry.exportHandler)
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/-/ready", registry.readyHandler)
+	http.HandleFunc("/-/reload", registry.reloadHandler)
+	http.HandleFunc("/sd", registry.sdHandler)
+	http.HandleFunc("/debug/instance", registry.debugHandler)
+	if samples != nil {
+		http.HandleFunc("GET /api/v1/instances/{resourceId}/samples", samples.samplesHandler)
+	}
+	http.HandleFunc("/", registry.statusHandler(cfg.metricsPath))
 
 	slog.Info("Listening on " + cfg.listenAddress)
-	err = http.ListenAndServe(cfg.listenAddress, nil)
-	if err != nil {
+	server := &http.Server{
+		Addr:              cfg.listenAddress,
+		ReadHeaderTimeout: cfg.readTimeout,
+		ReadTimeout:       cfg.readTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- listenAndServe(server, cfg.webConfigFile)
+	}()
+
+	select {
+	case err = <-errCh:
 		slog.Error("failed to listen", "err", err)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownGrace)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if store != nil {
+		// after in-flight scrapes, so that their cursors are saved too
+		if err := store.Save(registry.cursors()); err != nil {
+			slog.Error("failed to save state", "file", cfg.stateFile, "err", err)
+		}
+	}
+	if err != nil {
+		slog.Error("failed to shut down gracefully", "err", err)
+		os.Exit(1)
 	}
 }
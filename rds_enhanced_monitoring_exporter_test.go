@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +10,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	cloudwatchlogs "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	cloudwatchlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
@@ -151,6 +153,8 @@ func (c *mockedRDS) DescribeDBInstances(ctx context.Context, input *rds.Describe
 			{
 				DbiResourceId:        aws.String("db-AAAAAAAAAAAAAAAAAAAAAAAAAA"),
 				DBInstanceIdentifier: aws.String("AAA"),
+				DBInstanceArn:        aws.String("arn:aws:rds:us-east-1:111111111111:db:AAA"),
+				DBClusterIdentifier:  aws.String("cluster"),
 				DBInstanceClass:      aws.String("db.t2.meduim"),
 				StorageType:          aws.String("gp2"),
 				AvailabilityZone:     aws.String("us-east-1a"),
@@ -159,10 +163,18 @@ func (c *mockedRDS) DescribeDBInstances(ctx context.Context, input *rds.Describe
 				},
 				Engine:        aws.String("mysql"),
 				EngineVersion: aws.String("5.7"),
+				TagList: []rdsTypes.Tag{
+					{
+						Key:   aws.String("Environment"),
+						Value: aws.String("production"),
+					},
+				},
 			},
 			{
 				DbiResourceId:        aws.String("db-BBBBBBBBBBBBBBBBBBBBBBBBBB"),
 				DBInstanceIdentifier: aws.String("BBB"),
+				DBInstanceArn:        aws.String("arn:aws:rds:us-east-1:111111111111:db:BBB"),
+				DBClusterIdentifier:  aws.String("cluster"),
 				DBInstanceClass:      aws.String("db.t2.meduim"),
 				StorageType:          aws.String("gp2"),
 				AvailabilityZone:     aws.String("us-east-1a"),
@@ -171,6 +183,12 @@ func (c *mockedRDS) DescribeDBInstances(ctx context.Context, input *rds.Describe
 				},
 				Engine:        aws.String("mysql"),
 				EngineVersion: aws.String("5.7"),
+				TagList: []rdsTypes.Tag{
+					{
+						Key:   aws.String("Environment"),
+						Value: aws.String("production"),
+					},
+				},
 			},
 		},
 	}, nil
@@ -180,6 +198,18 @@ func (c *mockedRDS) DescribeDBClusters(ctx context.Context, input *rds.DescribeD
 	return &rds.DescribeDBClustersOutput{
 		DBClusters: []rdsTypes.DBCluster{
 			{
+				DBClusterIdentifier: aws.String("cluster"),
+				DBClusterArn:        aws.String("arn:aws:rds:us-east-1:111111111111:cluster:cluster"),
+				TagList: []rdsTypes.Tag{
+					{
+						Key:   aws.String("Environment"),
+						Value: aws.String("staging"),
+					},
+					{
+						Key:   aws.String("Team"),
+						Value: aws.String("dba"),
+					},
+				},
 				DBClusterMembers: []rdsTypes.DBClusterMember{
 					{
 						DBInstanceIdentifier: aws.String("AAA"),
@@ -200,6 +230,19 @@ type mockedRGT struct{}
 func (c *mockedRGT) GetResources(ctx context.Context, input *rgt.GetResourcesInput, optFns ...func(*rgt.Options)) (*rgt.GetResourcesOutput, error) {
 	return &rgt.GetResourcesOutput{
 		ResourceTagMappingList: []rgtTypes.ResourceTagMapping{
+			{
+				ResourceARN: aws.String("arn:aws:rds:us-east-1:111111111111:cluster:cluster"),
+				Tags: []rgtTypes.Tag{
+					{
+						Key:   aws.String("Environment"),
+						Value: aws.String("staging"),
+					},
+					{
+						Key:   aws.String("Team"),
+						Value: aws.String("dba"),
+					},
+				},
+			},
 			{
 				ResourceARN: aws.String("arn:aws:rds:us-east-1:111111111111:db:AAA"),
 				Tags: []rgtTypes.Tag{
@@ -253,3 +296,115 @@ func TestE2E(t *testing.T) {
 		t.Errorf("expected %s, got %s", expect, got)
 	}
 }
+
+// failingCloudWatchLogs fails GetLogEvents for one stream and delays the others.
+type failingCloudWatchLogs struct {
+	mockedCloudWatchLogs
+	failStream string
+	delay      time.Duration
+}
+
+func (c *failingCloudWatchLogs) DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	now := time.Now().UnixMilli()
+	return &cloudwatchlogs.DescribeLogStreamsOutput{
+		LogStreams: []cloudwatchlogsTypes.LogStream{
+			{LogStreamName: aws.String("db-AAAAAAAAAAAAAAAAAAAAAAAAAA"), LastEventTimestamp: aws.Int64(now)},
+			{LogStreamName: aws.String("db-BBBBBBBBBBBBBBBBBBBBBBBBBB"), LastEventTimestamp: aws.Int64(now)},
+		},
+	}, nil
+}
+
+func (c *failingCloudWatchLogs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	if *input.LogStreamName == c.failStream {
+		return nil, errors.New("internal failure")
+	}
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.mockedCloudWatchLogs.GetLogEvents(ctx, input, optFns...)
+}
+
+func scrapeAll(t *testing.T, e *Exporter, header http.Header) []string {
+	t.Helper()
+	err := e.collectRdsInfo(context.Background())
+	if err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+	writer := httptest.NewRecorder()
+	request := &http.Request{
+		URL: &url.URL{
+			RawQuery: "labels[]=DBInstanceIdentifier",
+		},
+		RemoteAddr: "127.0.0.1:9408",
+		Header:     header,
+	}
+	e.exportHandler(writer, request)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, writer.Code)
+	}
+
+	body, err := ioutil.ReadAll(writer.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(body), "\n")
+}
+
+func TestPartialResultsOnStreamError(t *testing.T) {
+	e := NewExporterWithClients(
+		&failingCloudWatchLogs{failStream: "db-BBBBBBBBBBBBBBBBBBBBBBBBBB"},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	outputs := scrapeAll(t, e, nil)
+
+	expect := map[string]bool{
+		"rds_enhanced_monitoring_up{DBInstanceIdentifier=\"AAA\"} 1.000000": true,
+		"rds_enhanced_monitoring_up{DBInstanceIdentifier=\"BBB\"} 0.000000": true,
+	}
+	found := 0
+	metrics := 0
+	for _, line := range outputs {
+		if expect[line] {
+			found++
+		}
+		if strings.HasPrefix(line, "rds_enhanced_monitoring_CpuUtilization_Guest") {
+			metrics++
+		}
+	}
+	if found != len(expect) {
+		t.Errorf("expected up series %v, got %v", expect, outputs)
+	}
+	if metrics == 0 {
+		t.Error("expected metrics of the healthy stream to be returned")
+	}
+}
+
+func TestScrapeTimeoutHeader(t *testing.T) {
+	e := NewExporterWithClients(
+		&failingCloudWatchLogs{delay: 5 * time.Second},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	e.scrapeTimeoutOffset = 0
+	start := time.Now()
+	outputs := scrapeAll(t, e, http.Header{"X-Prometheus-Scrape-Timeout-Seconds": []string{"0.2"}})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected scrape to stop at the deadline, took %s", elapsed)
+	}
+
+	up := 0
+	for _, line := range outputs {
+		if strings.HasPrefix(line, "rds_enhanced_monitoring_up{") {
+			up++
+			if !strings.HasSuffix(line, " 0.000000") {
+				t.Errorf("expected up to be 0, got %s", line)
+			}
+		}
+	}
+	if up != 2 {
+		t.Errorf("expected 2 up series, got %d", up)
+	}
+}
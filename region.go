@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+const defaultRegionProbeTimeout = time.Second
+
+// regionResolver resolves the region used when the configuration has no
+// targets, trying in order AWS_REGION and AWS_DEFAULT_REGION, the shared config
+// profile, the ECS task metadata and IMDSv2, as the AWS SDK and CLI do. There is
+// no fallback region: exporting the wrong region silently is worse than failing.
+type regionResolver struct {
+	profile        string
+	configFiles    []string
+	getenv         func(string) string
+	ecsMetadataURI string
+	imdsEndpoint   string
+	// timeout bounds each of the metadata probes
+	timeout    time.Duration
+	httpClient *http.Client
+}
+
+func newRegionResolver() *regionResolver {
+	ecsMetadataURI := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if ecsMetadataURI == "" {
+		ecsMetadataURI = os.Getenv("ECS_CONTAINER_METADATA_URI")
+	}
+	return &regionResolver{
+		profile:        os.Getenv("AWS_PROFILE"),
+		getenv:         os.Getenv,
+		ecsMetadataURI: ecsMetadataURI,
+		timeout:        defaultRegionProbeTimeout,
+		httpClient:     http.DefaultClient,
+	}
+}
+
+// resolve returns the first region found, or an error when there is none.
+func (r *regionResolver) resolve(ctx context.Context) (string, error) {
+	sources := []struct {
+		name    string
+		resolve func(context.Context) (string, error)
+	}{
+		{"environment", r.fromEnv},
+		{"shared config profile", r.fromProfile},
+		{"ECS task metadata", r.fromECS},
+		{"IMDSv2", r.fromIMDS},
+	}
+	var errs []error
+	for _, source := range sources {
+		region, err := source.resolve(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.name, err))
+			continue
+		}
+		if region != "" {
+			return region, nil
+		}
+	}
+	errs = append(errs, errors.New("no region found; set the region of a target in the config file or AWS_REGION"))
+	return "", errors.Join(errs...)
+}
+
+func (r *regionResolver) fromProfile(ctx context.Context) (string, error) {
+	profile := r.profile
+	if profile == "" {
+		profile = "default"
+	}
+	cfg, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+		if r.configFiles != nil {
+			o.ConfigFiles = r.configFiles
+			o.CredentialsFiles = []string{}
+		}
+	})
+	if err != nil {
+		var notExist config.SharedConfigProfileNotExistError
+		if errors.As(err, &notExist) && r.profile == "" {
+			return "", nil
+		}
+		return "", err
+	}
+	return cfg.Region, nil
+}
+
+func (r *regionResolver) fromEnv(ctx context.Context) (string, error) {
+	if region := r.getenv("AWS_REGION"); region != "" {
+		return region, nil
+	}
+	return r.getenv("AWS_DEFAULT_REGION"), nil
+}
+
+// fromECS reads the region from the ARN of the task in the ECS task metadata.
+func (r *regionResolver) fromECS(ctx context.Context) (string, error) {
+	if r.ecsMetadataURI == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.ecsMetadataURI, "/")+"/task", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	var task struct {
+		TaskARN string `json:"TaskARN"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return "", err
+	}
+	// arn:aws:ecs:<region>:<account>:task/...
+	parts := strings.SplitN(task.TaskARN, ":", 5)
+	if len(parts) < 5 || parts[3] == "" {
+		return "", fmt.Errorf("invalid task ARN: %q", task.TaskARN)
+	}
+	return parts[3], nil
+}
+
+// fromIMDS asks IMDSv2 without retries, so that hosts outside EC2 fail fast.
+func (r *regionResolver) fromIMDS(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	client := imds.New(imds.Options{
+		Endpoint:       r.imdsEndpoint,
+		Retryer:        aws.NopRetryer{},
+		EnableFallback: aws.FalseTernary,
+	})
+	output, err := client.GetRegion(ctx, &imds.GetRegionInput{})
+	if err != nil {
+		return "", err
+	}
+	return output.Region, nil
+}
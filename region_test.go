@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeIMDS serves the region over IMDSv2, rejecting requests without a session token.
+func newFakeIMDS(t *testing.T, region string, delay time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+			w.Write([]byte("token"))
+		case r.URL.Path == "/latest/dynamic/instance-identity/document":
+			if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"region":"` + region + `","availabilityZone":"` + region + `a"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestRegionResolver(t *testing.T, env map[string]string) *regionResolver {
+	t.Helper()
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	// an address nothing listens on, so IMDS fails unless a test sets its own
+	imds := httptest.NewServer(http.NotFoundHandler())
+	imds.Close()
+	return &regionResolver{
+		configFiles:  []string{filepath.Join(t.TempDir(), "config")},
+		getenv:       func(k string) string { return env[k] },
+		imdsEndpoint: imds.URL,
+		timeout:      200 * time.Millisecond,
+		httpClient:   http.DefaultClient,
+	}
+}
+
+func TestRegionResolverEnv(t *testing.T) {
+	tests := []struct {
+		env    map[string]string
+		expect string
+	}{
+		{map[string]string{"AWS_REGION": "ap-northeast-1", "AWS_DEFAULT_REGION": "us-west-2"}, "ap-northeast-1"},
+		{map[string]string{"AWS_DEFAULT_REGION": "us-west-2"}, "us-west-2"},
+	}
+	for _, tt := range tests {
+		got, err := newTestRegionResolver(t, tt.env).resolve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expect != got {
+			t.Errorf("expected %s, got %s", tt.expect, got)
+		}
+	}
+}
+
+func TestRegionResolverProfile(t *testing.T) {
+	env := map[string]string{"AWS_REGION": "us-west-2"}
+	r := newTestRegionResolver(t, env)
+	writeConfig(t, r.configFiles[0], "[default]\nregion = eu-west-1\n[profile ops]\nregion = eu-central-1\n")
+
+	// the environment overrides the profile
+	got, err := r.resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "us-west-2" {
+		t.Errorf("expected %s, got %s", "us-west-2", got)
+	}
+
+	delete(env, "AWS_REGION")
+	got, err = r.resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "eu-west-1" {
+		t.Errorf("expected %s, got %s", "eu-west-1", got)
+	}
+
+	r.profile = "ops"
+	got, err = r.resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "eu-central-1" {
+		t.Errorf("expected %s, got %s", "eu-central-1", got)
+	}
+}
+
+func TestRegionResolverECS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/task" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Cluster":"default","TaskARN":"arn:aws:ecs:sa-east-1:111111111111:task/default/0123456789abcdef","AvailabilityZone":"sa-east-1a"}`))
+	}))
+	defer server.Close()
+	r := newTestRegionResolver(t, nil)
+	r.ecsMetadataURI = server.URL + "/v4"
+
+	got, err := r.resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "sa-east-1" {
+		t.Errorf("expected %s, got %s", "sa-east-1", got)
+	}
+}
+
+func TestRegionResolverIMDS(t *testing.T) {
+	r := newTestRegionResolver(t, nil)
+	r.imdsEndpoint = newFakeIMDS(t, "ap-southeast-2", 0).URL
+
+	got, err := r.resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ap-southeast-2" {
+		t.Errorf("expected %s, got %s", "ap-southeast-2", got)
+	}
+}
+
+func TestRegionResolverNoRegion(t *testing.T) {
+	r := newTestRegionResolver(t, nil)
+	// IMDS answering after the timeout is treated as absent
+	r.imdsEndpoint = newFakeIMDS(t, "ap-southeast-2", time.Second).URL
+
+	start := time.Now()
+	_, err := r.resolve(context.Background())
+	if err == nil {
+		t.Fatal("expected error when no region is found")
+	}
+	if !strings.Contains(err.Error(), "no region found") {
+		t.Errorf("expected no region error, got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("expected IMDS probe to time out quickly, took %s", elapsed)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exporterFactory creates the exporter of a target.
+type exporterFactory func(ctx context.Context, target Target) (*Exporter, error)
+
+// regionalExporter is an exporter together with the cancel function of its inventory loop.
+type regionalExporter struct {
+	exporter *Exporter
+	cancel   context.CancelFunc
+}
+
+// Registry holds an exporter per target region and reloads them from the
+// configuration file. Exporters of targets kept across a reload are reused, so
+// the cursors of the scrapers are not lost.
+type Registry struct {
+	ctx        context.Context
+	configFile string
+	// defaultRegion resolves the region to export when there are no targets
+	defaultRegion   func(context.Context) (string, error)
+	refreshInterval time.Duration
+	newExporter     exporterFactory
+
+	// reloadLock serializes reloads
+	reloadLock sync.Mutex
+
+	lock      sync.RWMutex
+	config    Config
+	regions   []string
+	targets   map[string]Target
+	exporters map[string]*regionalExporter
+
+	lastReloadSuccessful bool
+	lastReloadSuccessAt  time.Time
+	lastReloadError      string
+
+	// restored are the saved cursors of the regions whose exporter is not started yet
+	restored cursors
+}
+
+func NewRegistry(ctx context.Context, configFile string, defaultRegion func(context.Context) (string, error), refreshInterval time.Duration, newExporter exporterFactory) *Registry {
+	return &Registry{
+		ctx:             ctx,
+		configFile:      configFile,
+		defaultRegion:   defaultRegion,
+		refreshInterval: refreshInterval,
+		newExporter:     newExporter,
+		exporters:       make(map[string]*regionalExporter),
+	}
+}
+
+// Reload loads and validates the configuration file, then starts exporters for
+// new or changed targets and stops the exporters of removed or changed targets.
+// The current exporters are kept as is when the configuration is invalid.
+func (r *Registry) Reload() error {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	err := r.reload()
+	r.lock.Lock()
+	r.lastReloadSuccessful = err == nil
+	if err == nil {
+		r.lastReloadSuccessAt = time.Now()
+		r.lastReloadError = ""
+	} else {
+		r.lastReloadError = err.Error()
+	}
+	r.lock.Unlock()
+	return err
+}
+
+func (r *Registry) reload() error {
+	cfg, err := LoadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	targets := cfg.Targets
+	if len(targets) == 0 {
+		region, err := r.defaultRegion(r.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to resolve region: %w", err)
+		}
+		target := Target{Region: region}
+		if err := target.validate(); err != nil {
+			return fmt.Errorf("resolved region: %w", err)
+		}
+		targets = []Target{target}
+	}
+
+	r.lock.RLock()
+	current := r.exporters
+	currentTargets := r.targets
+	r.lock.RUnlock()
+
+	regions := make([]string, 0, len(targets))
+	targetMap := make(map[string]Target)
+	exporters := make(map[string]*regionalExporter)
+	filters := make(map[string]*instanceFilter)
+	started := make([]*regionalExporter, 0)
+	// replaced are the exporters of changed targets, keyed by region
+	replaced := make(map[string]*regionalExporter)
+	// regions are unique, as validate rejects duplicate targets
+	for _, target := range targets {
+		regions = append(regions, target.Region)
+		targetMap[target.Region] = target
+		filter, err := newInstanceFilter(target.Filters)
+		if err != nil {
+			return fmt.Errorf("filters of %s: %w", target.Region, err)
+		}
+		filters[target.Region] = filter
+		if re, ok := current[target.Region]; ok {
+			if sameConnection(currentTargets[target.Region], target) {
+				exporters[target.Region] = re
+				continue
+			}
+			replaced[target.Region] = re
+		}
+		exporter, err := r.newExporter(r.ctx, target)
+		if err != nil {
+			return fmt.Errorf("failed to create exporter for %s: %w", target.Region, err)
+		}
+		exporters[target.Region] = &regionalExporter{exporter: exporter}
+		started = append(started, exporters[target.Region])
+	}
+
+	// filters of kept exporters are updated in place
+	for region, re := range exporters {
+		re.exporter.filter.Store(filters[region])
+	}
+
+	r.lock.Lock()
+	for region, re := range exporters {
+		if saved, ok := r.restored[region]; ok {
+			re.exporter.restoreCursors(saved)
+			delete(r.restored, region)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, re := range started {
+		ctx, cancel := context.WithCancel(r.ctx)
+		re.cancel = cancel
+		go re.exporter.runInventoryRefresher(ctx, r.refreshInterval)
+		go re.exporter.runSampleCollector(ctx)
+	}
+	r.lock.Lock()
+	r.config = *cfg
+	r.regions = regions
+	r.targets = targetMap
+	r.exporters = exporters
+	r.lock.Unlock()
+	for region, re := range replaced {
+		// scrapes still running on the old exporter may have advanced its cursors
+		exporters[region].exporter.inherit(re.exporter)
+		slog.Info("stopping exporter of changed target", "region", region)
+		re.cancel()
+	}
+	for region, re := range current {
+		if _, ok := exporters[region]; !ok {
+			slog.Info("stopping exporter of removed target", "region", region)
+			re.cancel()
+		}
+	}
+	slog.Info("loaded config", "file", r.configFile, "regions", strings.Join(regions, ","))
+	return nil
+}
+
+// sameConnection reports whether an exporter of a can be reused for b, which is
+// when they only differ by their filters, as filters are updated in place.
+func sameConnection(a Target, b Target) bool {
+	a.Filters = Filters{}
+	b.Filters = Filters{}
+	return reflect.DeepEqual(a, b)
+}
+
+// inherit carries over the cursors, last events and counters of the exporter
+// old replaces, so that a changed target does not export events again nor
+// restart its counters.
+func (e *Exporter) inherit(old *Exporter) {
+	e.restoreCursors(old.snapshotCursors())
+
+	old.streamLock.Lock()
+	lastEvents := make(map[string]int64, len(old.lastEvents))
+	for s, timestamp := range old.lastEvents {
+		lastEvents[s] = timestamp
+	}
+	old.streamLock.Unlock()
+	for s, timestamp := range lastEvents {
+		e.recordLastEvent(s, timestamp)
+	}
+
+	old.counterLock.Lock()
+	counters := make(map[string]*counterState, len(old.counters))
+	for s, state := range old.counters {
+		copied := *state
+		copied.values = make(map[string]counterValue, len(state.values))
+		for k, v := range state.values {
+			copied.values[k] = v
+		}
+		counters[s] = &copied
+	}
+	old.counterLock.Unlock()
+	e.counterLock.Lock()
+	for s, state := range counters {
+		if current, ok := e.counters[s]; !ok || current.timestamp < state.timestamp {
+			e.counters[s] = state
+		}
+	}
+	e.counterLock.Unlock()
+}
+
+// exporter returns the exporter of region, or of the first target when region is empty.
+func (r *Registry) exporter(region string) (*Exporter, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if region == "" {
+		if len(r.regions) == 0 {
+			return nil, false
+		}
+		region = r.regions[0]
+	}
+	re, ok := r.exporters[region]
+	if !ok {
+		return nil, false
+	}
+	return re.exporter, true
+}
+
+// target returns the target of region, or of the first target when region is empty.
+func (r *Registry) target(region string) (Target, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if region == "" {
+		if len(r.regions) == 0 {
+			return Target{}, false
+		}
+		region = r.regions[0]
+	}
+	t, ok := r.targets[region]
+	return t, ok
+}
+
+// metrics returns the config reload metrics in the text exposition format.
+func (r *Registry) metrics() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	successful := 0
+	if r.lastReloadSuccessful {
+		successful = 1
+	}
+	timestamp := 0.0
+	if !r.lastReloadSuccessAt.IsZero() {
+		timestamp = float64(r.lastReloadSuccessAt.UnixNano()) / 1e9
+	}
+	return []string{
+		fmt.Sprintf("%s_exporter_config_last_reload_successful %d", namespace, successful),
+		fmt.Sprintf("%s_exporter_config_last_reload_success_timestamp_seconds %f", namespace, timestamp),
+	}
+}
+
+// exportHandler scrapes the exporter of the region query parameter, defaulting
+// to the first target.
+func (r *Registry) exportHandler(w http.ResponseWriter, req *http.Request) {
+	region := req.URL.Query().Get("region")
+	e, ok := r.exporter(region)
+	if !ok {
+		http.Error(w, fmt.Sprintf("region %s is not a target", region), http.StatusBadRequest)
+		return
+	}
+	buf, err := e.collect(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf = append(buf, r.metrics()...)
+	writeMetrics(w, req, buf)
+}
+
+// reloadHandler reloads the configuration on POST /-/reload.
+func (r *Registry) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		slog.Error("failed to reload config", "err", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// readyHandler reports ready once the inventory of every target has been collected.
+func (r *Registry) readyHandler(w http.ResponseWriter, req *http.Request) {
+	r.lock.RLock()
+	ready := len(r.exporters) > 0
+	for _, re := range r.exporters {
+		ready = ready && re.exporter.ready.Load()
+	}
+	r.lock.RUnlock()
+	if !ready {
+		http.Error(w, "Service Unavailable: inventory has not been collected yet.", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ready.\n"))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T, configFile string) *Registry {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	defaultRegion := func(context.Context) (string, error) {
+		return "us-east-1", nil
+	}
+	return NewRegistry(ctx, configFile, defaultRegion, time.Hour, func(ctx context.Context, target Target) (*Exporter, error) {
+		e := NewExporterWithClients(
+			&mockedCloudWatchLogs{},
+			&mockedRDS{},
+			&mockedRGT{},
+		)
+		e.region = target.Region
+		return e, nil
+	})
+}
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryReload(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n  - region: ap-northeast-1\n")
+	r := newTestRegistry(t, configFile)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	first, ok := r.exporter("")
+	if !ok || first.region != "us-east-1" {
+		t.Fatal("expected the first target to be the default exporter")
+	}
+	if _, ok := r.exporter("ap-northeast-1"); !ok {
+		t.Error("expected exporter of ap-northeast-1")
+	}
+
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.exporter("ap-northeast-1"); ok {
+		t.Error("expected exporter of ap-northeast-1 to be removed")
+	}
+	if e, _ := r.exporter("us-east-1"); e != first {
+		t.Error("expected exporter of a kept region to be reused")
+	}
+
+	writeConfig(t, configFile, "targets:\n  - region: \"\"\n")
+	if err := r.Reload(); err == nil {
+		t.Error("expected invalid config to be rejected")
+	}
+	if e, _ := r.exporter("us-east-1"); e != first {
+		t.Error("expected exporters to be kept when the config is invalid")
+	}
+	metrics := strings.Join(r.metrics(), "\n")
+	if !strings.Contains(metrics, "rds_enhanced_monitoring_exporter_config_last_reload_successful 0") {
+		t.Errorf("expected failed reload to be reported, got %s", metrics)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n")
+	r := newTestRegistry(t, configFile)
+
+	writer := httptest.NewRecorder()
+	r.reloadHandler(writer, httptest.NewRequest("GET", "/-/reload", nil))
+	if writer.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got %d", http.StatusMethodNotAllowed, writer.Code)
+	}
+
+	writer = httptest.NewRecorder()
+	r.reloadHandler(writer, httptest.NewRequest("POST", "/-/reload", nil))
+	if writer.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, writer.Code)
+	}
+
+	writer = httptest.NewRecorder()
+	r.exportHandler(writer, httptest.NewRequest("GET", "/metrics?region=eu-west-1", nil))
+	if writer.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for unknown region, got %d", http.StatusBadRequest, writer.Code)
+	}
+
+	writer = httptest.NewRecorder()
+	r.exportHandler(writer, httptest.NewRequest("GET", "/metrics?region=us-east-1&ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA", nil))
+	body := writer.Body.String()
+	if !strings.Contains(body, "rds_enhanced_monitoring_exporter_config_last_reload_successful 1") {
+		t.Errorf("expected successful reload to be reported, got %s", body)
+	}
+}
+
+// endpointCloudWatchLogs records the endpoint of the target it was created for.
+type endpointCloudWatchLogs struct {
+	mockedCloudWatchLogs
+	endpoint string
+}
+
+func TestRegistryReloadChangedTarget(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n    endpoints:\n      logs: http://localhost:4566\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	r := NewRegistry(ctx, configFile, nil, time.Hour, func(ctx context.Context, target Target) (*Exporter, error) {
+		e := NewExporterWithClients(
+			&endpointCloudWatchLogs{endpoint: target.Endpoints.Logs},
+			&mockedRDS{},
+			&mockedRGT{},
+		)
+		e.region = target.Region
+		return e, nil
+	})
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := r.exporter("")
+	first.advanceCursor("192.0.2.1", "db-AAAAAAAAAAAAAAAAAAAAAAAAAA", time.Now().UnixMilli())
+
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n    endpoints:\n      logs: http://localhost:4566\n    filters:\n      engines: [mysql]\n")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := r.exporter(""); e != first {
+		t.Error("expected exporter to be reused when only filters change")
+	}
+
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n    endpoints:\n      logs: http://localhost:4567\n    role_arn: arn:aws:iam::111111111111:role/exporter\n")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("")
+	if e == first {
+		t.Fatal("expected exporter to be replaced when the target changes")
+	}
+	if got := e.cwLogsClient.(*endpointCloudWatchLogs).endpoint; got != "http://localhost:4567" {
+		t.Errorf("expected %s, got %s", "http://localhost:4567", got)
+	}
+	if _, ok := e.cursor("192.0.2.1", "db-AAAAAAAAAAAAAAAAAAAAAAAAAA"); !ok {
+		t.Error("expected cursors to be carried over")
+	}
+}
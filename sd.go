@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// sdTargetGroup is a target group of the Prometheus HTTP service discovery.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdTargetGroups returns a target group per selected instance with Enhanced
+// Monitoring enabled. The target is the exporter itself at host, and the
+// ResourceId and region parameters select the instance.
+func (r *Registry) sdTargetGroups(host string) []sdTargetGroup {
+	r.lock.RLock()
+	regions := r.regions
+	exporters := r.exporters
+	r.lock.RUnlock()
+
+	groups := make([]sdTargetGroup, 0)
+	for _, region := range regions {
+		e := exporters[region].exporter
+		for _, resourceID := range e.inventoryStreams() {
+			e.lock.RLock()
+			instance := e.instanceMap[resourceID]
+			e.lock.RUnlock()
+			groups = append(groups, sdTargetGroup{
+				Targets: []string{host},
+				Labels: map[string]string{
+					"__param_ResourceId":   resourceID,
+					"__param_region":       region,
+					"region":               region,
+					"DBInstanceIdentifier": aws.ToString(instance.DBInstanceIdentifier),
+					"DBInstanceClass":      aws.ToString(instance.DBInstanceClass),
+					"Engine":               aws.ToString(instance.Engine),
+				},
+			})
+		}
+	}
+	return groups
+}
+
+// sdHandler serves the instances to scrape in the Prometheus HTTP service discovery format.
+func (r *Registry) sdHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.sdTargetGroups(req.Host))
+}
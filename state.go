@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateVersion = 1
+
+	defaultStateFlushInterval = 30 * time.Second
+	// cursors not advanced for this long are dropped, so scrapers that went away do not accumulate
+	stateCursorRetention = 24 * time.Hour
+)
+
+// cursors are the timestamps, in milliseconds, of the last event of each stream
+// exported to each scraper, keyed by region, scraper address and stream.
+type cursors map[string]map[string]map[string]int64
+
+type stateFile struct {
+	Version int     `json:"version"`
+	Cursors cursors `json:"cursors"`
+}
+
+// StateStore persists the scrape cursors in a JSON file, so that a restarted
+// exporter does not export events that were already scraped.
+type StateStore struct {
+	path string
+}
+
+func NewStateStore(path string) *StateStore {
+	return &StateStore{path: path}
+}
+
+// Load returns the cursors of the state file. A missing file is an empty state.
+// A file that can not be read as the current version is moved aside to
+// <path>.corrupt and the state starts empty, as losing the cursors only causes
+// a few duplicate samples.
+func (s *StateStore) Load() (cursors, error) {
+	buf, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cursors{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state stateFile
+	err = json.Unmarshal(buf, &state)
+	if err == nil && state.Version != stateVersion {
+		err = fmt.Errorf("unsupported version %d", state.Version)
+	}
+	if err != nil {
+		slog.Warn("ignoring unreadable state file", "file", s.path, "err", err)
+		if err := os.Rename(s.path, s.path+".corrupt"); err != nil {
+			slog.Warn("failed to move unreadable state file aside", "file", s.path, "err", err)
+		}
+		return cursors{}, nil
+	}
+	if state.Cursors == nil {
+		state.Cursors = cursors{}
+	}
+	return state.Cursors, nil
+}
+
+// Save writes the cursors to a temporary file and renames it over the state
+// file, so that a crash while saving leaves the previous state intact.
+func (s *StateStore) Save(c cursors) error {
+	buf, err := json.Marshal(stateFile{Version: stateVersion, Cursors: c})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// snapshotCursors returns a copy of the cursors of the exporter, without those
+// older than stateCursorRetention.
+func (e *Exporter) snapshotCursors() map[string]map[string]int64 {
+	threshold := time.Now().Add(-stateCursorRetention).UnixMilli()
+	e.cursorLock.Lock()
+	defer e.cursorLock.Unlock()
+	snapshot := make(map[string]map[string]int64)
+	for remoteAddr, streams := range e.lastUpdated {
+		for s, timestamp := range streams {
+			if timestamp < threshold {
+				continue
+			}
+			if _, ok := snapshot[remoteAddr]; !ok {
+				snapshot[remoteAddr] = make(map[string]int64)
+			}
+			snapshot[remoteAddr][s] = timestamp
+		}
+	}
+	return snapshot
+}
+
+// restoreCursors merges saved cursors into the exporter.
+func (e *Exporter) restoreCursors(saved map[string]map[string]int64) {
+	for remoteAddr, streams := range saved {
+		for s, timestamp := range streams {
+			e.advanceCursor(remoteAddr, s, timestamp)
+		}
+	}
+}
+
+// cursors returns the cursors of every exporter. Regions whose exporter has not
+// been started are kept from the restored state.
+func (r *Registry) cursors() cursors {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c := cursors{}
+	for region, saved := range r.restored {
+		c[region] = saved
+	}
+	for region, re := range r.exporters {
+		c[region] = re.exporter.snapshotCursors()
+	}
+	return c
+}
+
+// restoreState sets the cursors to restore into the exporters as they are started.
+func (r *Registry) restoreState(c cursors) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.restored = c
+}
+
+// runStateFlusher saves the cursors every interval until ctx is done. The final
+// save on shutdown is left to the caller, after in-flight scrapes have finished.
+func (r *Registry) runStateFlusher(ctx context.Context, store *StateStore, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := store.Save(r.cursors()); err != nil {
+				slog.Warn("failed to save state", "file", store.path, "err", err)
+			}
+		}
+	}
+}
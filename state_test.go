@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStateStore(filepath.Join(dir, "state.json"))
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected empty state for a missing file, got %v", got)
+	}
+
+	expect := cursors{"us-east-1": {"192.0.2.1": {"db-AAAAAAAAAAAAAAAAAAAAAAAAAA": 1600000000000}}}
+	if err := store.Save(expect); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary file left, got %d entries", len(entries))
+	}
+}
+
+func TestStateStoreCorrupt(t *testing.T) {
+	for _, content := range []string{`{"version":1,"cursors":`, `{"version":2,"cursors":{}}`} {
+		path := filepath.Join(t.TempDir(), "state.json")
+		writeConfig(t, path, content)
+
+		got, err := NewStateStore(path).Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty state for %s, got %v", content, got)
+		}
+		if _, err := os.Stat(path + ".corrupt"); err != nil {
+			t.Errorf("expected %s to be moved aside: %s", content, err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", path)
+		}
+	}
+}
+
+func TestRegistryRestoreState(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n")
+	r := newTestRegistry(t, configFile)
+
+	now := time.Now().UnixMilli()
+	stale := time.Now().Add(-2 * stateCursorRetention).UnixMilli()
+	r.restoreState(cursors{
+		"us-east-1":      {"192.0.2.1": {"db-AAAAAAAAAAAAAAAAAAAAAAAAAA": now, "db-BBBBBBBBBBBBBBBBBBBBBBBBBB": stale}},
+		"ap-northeast-1": {"192.0.2.1": {"db-CCCCCCCCCCCCCCCCCCCCCCCCCC": now}},
+	})
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("us-east-1")
+	if got, ok := e.cursor("192.0.2.1", "db-AAAAAAAAAAAAAAAAAAAAAAAAAA"); !ok || got != now {
+		t.Errorf("expected %d, got %d", now, got)
+	}
+
+	expect := cursors{
+		"us-east-1":      {"192.0.2.1": {"db-AAAAAAAAAAAAAAAAAAAAAAAAAA": now}},
+		"ap-northeast-1": {"192.0.2.1": {"db-CCCCCCCCCCCCCCCCCCCCCCCCCC": now}},
+	}
+	if got := r.cursors(); !reflect.DeepEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+const (
+	// scrapes kept per scraper for the status page
+	scrapeHistoryLength = 10
+	// scrapers that have not scraped for this long are dropped from the history
+	scrapeHistoryRetention = 1 * time.Hour
+)
+
+// scrapeRecord is the outcome of one scrape.
+type scrapeRecord struct {
+	Scraper       string
+	ResourceID    string
+	Start         time.Time
+	Duration      time.Duration
+	Series        int
+	FailedStreams int
+	Error         string
+}
+
+// scrapeHistory keeps the latest scrapes of every scraper.
+type scrapeHistory struct {
+	mu      sync.Mutex
+	scrapes map[string][]scrapeRecord
+}
+
+func newScrapeHistory() *scrapeHistory {
+	return &scrapeHistory{scrapes: make(map[string][]scrapeRecord)}
+}
+
+func (h *scrapeHistory) record(s scrapeRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	scrapes := append(h.scrapes[s.Scraper], s)
+	if len(scrapes) > scrapeHistoryLength {
+		scrapes = scrapes[len(scrapes)-scrapeHistoryLength:]
+	}
+	h.scrapes[s.Scraper] = scrapes
+	threshold := s.Start.Add(-scrapeHistoryRetention)
+	for scraper, scrapes := range h.scrapes {
+		if scrapes[len(scrapes)-1].Start.Before(threshold) {
+			delete(h.scrapes, scraper)
+		}
+	}
+}
+
+// scraperStatus is the scrape history of one scraper, newest first.
+type scraperStatus struct {
+	Scraper string
+	Scrapes []scrapeRecord
+}
+
+func (h *scrapeHistory) status() []scraperStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	scrapers := make([]scraperStatus, 0, len(h.scrapes))
+	for scraper, scrapes := range h.scrapes {
+		s := scraperStatus{Scraper: scraper, Scrapes: make([]scrapeRecord, 0, len(scrapes))}
+		for i := len(scrapes) - 1; i >= 0; i-- {
+			s.Scrapes = append(s.Scrapes, scrapes[i])
+		}
+		scrapers = append(scrapers, s)
+	}
+	sort.Slice(scrapers, func(i, j int) bool { return scrapers[i].Scraper < scrapers[j].Scraper })
+	return scrapers
+}
+
+type instanceStatus struct {
+	ResourceID         string
+	Identifier         string
+	Engine             string
+	EngineVersion      string
+	Class              string
+	Cluster            string
+	Role               string
+	MonitoringInterval int32
+	Selected           bool
+	Tags               string
+}
+
+type streamStatus struct {
+	Stream     string
+	Identifier string
+	LastEvent  time.Time
+	Age        time.Duration
+}
+
+type regionStatus struct {
+	Region      string
+	Target      Target
+	Ready       bool
+	RefreshedAt time.Time
+	Instances   []instanceStatus
+	Streams     []streamStatus
+	Scrapers    []scraperStatus
+}
+
+type statusPage struct {
+	MetricsPath          string
+	ConfigFile           string
+	Config               string
+	LastReloadSuccessful bool
+	LastReloadSuccessAt  time.Time
+	LastReloadError      string
+	Regions              []regionStatus
+	Now                  time.Time
+}
+
+// clusterRole returns writer or reader for a cluster member and standalone otherwise.
+func clusterRole(member rdsTypes.DBClusterMember, ok bool) string {
+	if !ok {
+		return "standalone"
+	}
+	if aws.ToBool(member.IsClusterWriter) {
+		return "writer"
+	}
+	return "reader"
+}
+
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// inventoryStatus returns the instances of the inventory and when it was last refreshed.
+func (e *Exporter) inventoryStatus() ([]instanceStatus, time.Time) {
+	type entry struct {
+		instance rdsTypes.DBInstance
+		member   rdsTypes.DBClusterMember
+		ok       bool
+	}
+	e.lock.RLock()
+	refreshedAt := e.refreshedAt
+	entries := make([]entry, 0, len(e.instanceMap))
+	for _, instance := range e.instanceMap {
+		member, ok := e.memberMap[aws.ToString(instance.DBInstanceIdentifier)]
+		entries = append(entries, entry{instance: instance, member: member, ok: ok})
+	}
+	e.lock.RUnlock()
+
+	instances := make([]instanceStatus, 0, len(entries))
+	for _, entry := range entries {
+		tags, _ := e.lookupTags(entry.instance)
+		instances = append(instances, instanceStatus{
+			ResourceID:         aws.ToString(entry.instance.DbiResourceId),
+			Identifier:         aws.ToString(entry.instance.DBInstanceIdentifier),
+			Engine:             aws.ToString(entry.instance.Engine),
+			EngineVersion:      aws.ToString(entry.instance.EngineVersion),
+			Class:              aws.ToString(entry.instance.DBInstanceClass),
+			Cluster:            aws.ToString(entry.instance.DBClusterIdentifier),
+			Role:               clusterRole(entry.member, entry.ok),
+			MonitoringInterval: aws.ToInt32(entry.instance.MonitoringInterval),
+			Selected:           e.selected(entry.instance),
+			Tags:               formatTags(tags),
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Identifier < instances[j].Identifier })
+	return instances, refreshedAt
+}
+
+// streamStatus returns the streams whose last event is within activeStreamWindow of now.
+func (e *Exporter) streamStatus(now time.Time) []streamStatus {
+	e.streamLock.Lock()
+	lastEvents := make(map[string]int64, len(e.lastEvents))
+	for s, timestamp := range e.lastEvents {
+		lastEvents[s] = timestamp
+	}
+	e.streamLock.Unlock()
+
+	streams := make([]streamStatus, 0, len(lastEvents))
+	e.lock.RLock()
+	for s, timestamp := range lastEvents {
+		lastEvent := time.UnixMilli(timestamp)
+		if now.Sub(lastEvent) > activeStreamWindow {
+			continue
+		}
+		streams = append(streams, streamStatus{
+			Stream:     s,
+			Identifier: aws.ToString(e.instanceMap[s].DBInstanceIdentifier),
+			LastEvent:  lastEvent,
+			Age:        now.Sub(lastEvent),
+		})
+	}
+	e.lock.RUnlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Stream < streams[j].Stream })
+	return streams
+}
+
+func (r *Registry) status(now time.Time) statusPage {
+	r.lock.RLock()
+	page := statusPage{
+		ConfigFile:           r.configFile,
+		LastReloadSuccessful: r.lastReloadSuccessful,
+		LastReloadSuccessAt:  r.lastReloadSuccessAt,
+		LastReloadError:      r.lastReloadError,
+		Now:                  now,
+	}
+	config := r.config
+	regions := r.regions
+	targets := r.targets
+	exporters := r.exporters
+	r.lock.RUnlock()
+
+	if buf, err := config.masked(); err == nil {
+		page.Config = string(buf)
+	}
+	for _, region := range regions {
+		e := exporters[region].exporter
+		instances, refreshedAt := e.inventoryStatus()
+		page.Regions = append(page.Regions, regionStatus{
+			Region:      region,
+			Target:      targets[region],
+			Ready:       e.ready.Load(),
+			RefreshedAt: refreshedAt,
+			Instances:   instances,
+			Streams:     e.streamStatus(now),
+			Scrapers:    e.scrapes.status(),
+		})
+	}
+	return page
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"age": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"ms": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+	"timestamp": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>RDS Enhanced Monitoring Exporter</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>RDS Enhanced Monitoring Exporter</h1>
+<p><a href="{{.MetricsPath}}">Metrics</a> | <a href="/sd">Service discovery</a> | <a href="/-/ready">Readiness</a></p>
+
+<h2>Configuration</h2>
+<p>File: {{.ConfigFile}}</p>
+{{if .LastReloadSuccessful}}<p>Last reload successful at {{timestamp .LastReloadSuccessAt}}</p>
+{{else}}<p class="error">Last reload failed: {{.LastReloadError}} (last success: {{timestamp .LastReloadSuccessAt}})</p>
+{{end}}<pre>{{.Config}}</pre>
+<table>
+<tr><th>Region</th><th>Role ARN</th><th>Profile</th><th>Credential source</th><th>Ready</th><th>Inventory refreshed</th></tr>
+{{range .Regions}}<tr><td>{{.Region}}</td><td>{{.Target.RoleARN}}</td><td>{{.Target.Profile}}</td><td>{{.Target.CredentialSource}}</td><td>{{.Ready}}</td><td>{{timestamp .RefreshedAt}}</td></tr>
+{{end}}</table>
+{{range .Regions}}
+<h2>{{.Region}}</h2>
+
+<h3>Inventory</h3>
+<table>
+<tr><th>Identifier</th><th>Resource ID</th><th>Engine</th><th>Class</th><th>Cluster</th><th>Role</th><th>Monitoring interval</th><th>Selected</th><th>Tags</th></tr>
+{{range .Instances}}<tr><td>{{.Identifier}}</td><td>{{.ResourceID}}</td><td>{{.Engine}} {{.EngineVersion}}</td><td>{{.Class}}</td><td>{{.Cluster}}</td><td>{{.Role}}</td><td>{{.MonitoringInterval}}</td><td>{{.Selected}}</td><td>{{.Tags}}</td></tr>
+{{end}}</table>
+
+<h3>Log streams</h3>
+<table>
+<tr><th>Stream</th><th>Identifier</th><th>Last event</th><th>Age</th></tr>
+{{range .Streams}}<tr><td>{{.Stream}}</td><td>{{.Identifier}}</td><td>{{timestamp .LastEvent}}</td><td>{{age .Age}}</td></tr>
+{{end}}</table>
+
+<h3>Recent scrapes</h3>
+<table>
+<tr><th>Scraper</th><th>Start</th><th>ResourceId</th><th>Duration</th><th>Series</th><th>Failed streams</th><th>Error</th></tr>
+{{range .Scrapers}}{{range .Scrapes}}<tr><td>{{.Scraper}}</td><td>{{timestamp .Start}}</td><td>{{.ResourceID}}</td><td>{{ms .Duration}}</td><td>{{.Series}}</td><td>{{.FailedStreams}}</td><td class="error">{{.Error}}</td></tr>
+{{end}}{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// statusHandler serves the status page at /.
+func (r *Registry) statusHandler(metricsPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		page := r.status(time.Now())
+		page.MetricsPath = metricsPath
+		var buf strings.Builder
+		if err := statusTemplate.Execute(&buf, page); err != nil {
+			slog.Error("failed to render status page", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(buf.String()))
+	}
+}
+
+// scrapeError describes the failure of a scrape for the history, if any.
+func scrapeError(err error, deadlineExceeded bool) string {
+	switch {
+	case err != nil:
+		return err.Error()
+	case deadlineExceeded:
+		return "scrape deadline is reached"
+	}
+	return ""
+}
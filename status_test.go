@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusHandler(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, configFile, "targets:\n  - region: us-east-1\n    external_id: secret-external-id\n    role_arn: arn:aws:iam::111111111111:role/exporter\n")
+	r := newTestRegistry(t, configFile)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := r.exporter("")
+	if err := e.collectRdsInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "/metrics?ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA", nil)
+	request.RemoteAddr = "192.0.2.1:12345"
+	r.exportHandler(httptest.NewRecorder(), request)
+
+	writer := httptest.NewRecorder()
+	r.statusHandler("/metrics")(writer, httptest.NewRequest("GET", "/", nil))
+	if writer.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, writer.Code)
+	}
+	body := writer.Body.String()
+	for _, expect := range []string{
+		`<a href="/metrics">Metrics</a>`,
+		"arn:aws:iam::111111111111:role/exporter",
+		"<td>AAA</td><td>db-AAAAAAAAAAAAAAAAAAAAAAAAAA</td>",
+		"<td>writer</td>",
+		"<td>reader</td>",
+		"Environment=production, Team=dba",
+		"<td>192.0.2.1</td>",
+		"Last reload successful",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("expected %s, got %s", expect, body)
+		}
+	}
+	if strings.Contains(body, "secret-external-id") {
+		t.Errorf("expected external_id to be masked, got %s", body)
+	}
+
+	writeConfig(t, configFile, "targets:\n  - region: \"<us-east-1>\"\n")
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	writer = httptest.NewRecorder()
+	r.statusHandler("/metrics")(writer, httptest.NewRequest("GET", "/", nil))
+	body = writer.Body.String()
+	if !strings.Contains(body, "Last reload failed") {
+		t.Errorf("expected failed reload to be shown, got %s", body)
+	}
+	if strings.Contains(body, "<us-east-1>") || !strings.Contains(body, "&lt;us-east-1&gt;") {
+		t.Errorf("expected the error to be escaped, got %s", body)
+	}
+
+	writer = httptest.NewRecorder()
+	r.statusHandler("/metrics")(writer, httptest.NewRequest("GET", "/unknown", nil))
+	if writer.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, writer.Code)
+	}
+}
+
+func TestStreamStatus(t *testing.T) {
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	if err := e.collectRdsInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lastEvent := time.UnixMilli(1486977657000)
+	e.recordLastEvent("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", lastEvent.UnixMilli())
+	e.recordLastEvent("db-BBBBBBBBBBBBBBBBBBBBBBBBBB", lastEvent.Add(-2*activeStreamWindow).UnixMilli())
+
+	streams := e.streamStatus(lastEvent.Add(90 * time.Second))
+	if len(streams) != 1 {
+		t.Fatalf("expected only the active stream, got %v", streams)
+	}
+	if streams[0].Identifier != "AAA" {
+		t.Errorf("expected %s, got %s", "AAA", streams[0].Identifier)
+	}
+	if streams[0].Age != 90*time.Second {
+		t.Errorf("expected %s, got %s", 90*time.Second, streams[0].Age)
+	}
+}
+
+func TestScrapeHistory(t *testing.T) {
+	h := newScrapeHistory()
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < scrapeHistoryLength+5; i++ {
+		h.record(scrapeRecord{Scraper: "192.0.2.1", Start: start.Add(time.Duration(i) * time.Minute), Series: i})
+	}
+	h.record(scrapeRecord{Scraper: "192.0.2.2", Start: start.Add(-scrapeHistoryRetention)})
+	h.record(scrapeRecord{Scraper: "192.0.2.1", Start: start.Add(scrapeHistoryRetention), Series: 100})
+
+	scrapers := h.status()
+	if len(scrapers) != 1 {
+		t.Fatalf("expected idle scrapers to be dropped, got %v", scrapers)
+	}
+	if len(scrapers[0].Scrapes) != scrapeHistoryLength {
+		t.Errorf("expected %d, got %d", scrapeHistoryLength, len(scrapers[0].Scrapes))
+	}
+	if scrapers[0].Scrapes[0].Series != 100 {
+		t.Errorf("expected newest scrape first, got %v", scrapers[0].Scrapes[0])
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+const (
+	// streamSourceLogs lists the streams with DescribeLogStreams
+	streamSourceLogs = "logs"
+	// streamSourceInventory derives the streams from the RDS inventory: an instance
+	// with MonitoringInterval > 0 publishes to a stream named after its DbiResourceId
+	streamSourceInventory = "inventory"
+
+	defaultStreamCacheTTL = 1 * time.Minute
+	// streams without events for this long are not scraped
+	activeStreamWindow = 1 * time.Hour
+	// describeStreamsTimeout bounds a shared listing, which outlives the scrape that started it
+	describeStreamsTimeout = 1 * time.Minute
+)
+
+// activeStreams returns the log streams that received events recently.
+// DescribeLogStreams results are cached for streamCacheTTL and shared by all scrapes.
+func (e *Exporter) activeStreams(ctx context.Context) ([]string, error) {
+	if e.streamSource == streamSourceInventory {
+		return e.inventoryStreams(), nil
+	}
+
+	e.streamLock.Lock()
+	if e.streams != nil && time.Since(e.streamsFetchedAt) < e.streamCacheTTL {
+		streams := e.streams
+		e.streamLock.Unlock()
+		return streams, nil
+	}
+	e.streamLock.Unlock()
+
+	v, err, _ := e.streamGroup.Do("RDSOSMetrics", func() (interface{}, error) {
+		// the listing is shared with the scrapes waiting for it, so that it is not
+		// cancelled with the scrape that happened to start it
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), describeStreamsTimeout)
+		defer cancel()
+		streams, err := e.describeActiveStreams(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e.streamLock.Lock()
+		e.streams = streams
+		e.streamsFetchedAt = time.Now()
+		e.streamLock.Unlock()
+		return streams, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]string), nil
+}
+
+func (e *Exporter) describeActiveStreams(ctx context.Context) ([]string, error) {
+	streams := make([]string, 0)
+	paginator := cloudwatchlogs.NewDescribeLogStreamsPaginator(
+		e.cwLogsClient,
+		&cloudwatchlogs.DescribeLogStreamsInput{
+			LogGroupName: aws.String("RDSOSMetrics"),
+			OrderBy:      "LastEventTime",
+			Descending:   aws.Bool(true),
+		},
+	)
+	threshold := time.Now().Add(-activeStreamWindow)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, stream := range output.LogStreams {
+			if stream.LastEventTimestamp == nil {
+				continue
+			}
+			// the age of stale streams is recorded too, as they are the ones
+			// rds_enhanced_monitoring_last_event_age_seconds is meant to catch
+			e.recordLastEvent(*stream.LogStreamName, *stream.LastEventTimestamp)
+			if !time.UnixMilli(*stream.LastEventTimestamp).After(threshold) {
+				continue
+			}
+			streams = append(streams, *stream.LogStreamName)
+		}
+	}
+	return streams, nil
+}
+
+func (e *Exporter) inventoryStreams() []string {
+	e.lock.RLock()
+	streams := make([]string, 0, len(e.instanceMap))
+	for resourceID, instance := range e.instanceMap {
+		if instance.MonitoringInterval != nil && *instance.MonitoringInterval > 0 {
+			streams = append(streams, resourceID)
+		}
+	}
+	e.lock.RUnlock()
+	sort.Strings(streams)
+	return e.selectStreams(streams)
+}
+
+// recordLastEvent remembers the latest event timestamp, in milliseconds, seen for a stream.
+func (e *Exporter) recordLastEvent(stream string, timestamp int64) {
+	e.streamLock.Lock()
+	defer e.streamLock.Unlock()
+	if timestamp > e.lastEvents[stream] {
+		e.lastEvents[stream] = timestamp
+	}
+}
+
+// inventoryMetrics reports the Enhanced Monitoring configuration of every known
+// instance, or of resourceID only when it is given, so that instances whose
+// monitoring is disabled or has stopped publishing are visible.
+func (e *Exporter) inventoryMetrics(resourceID string, targetLabels []string) []string {
+	e.lock.RLock()
+	instances := make([]rdsTypes.DBInstance, 0, len(e.instanceMap))
+	for id, instance := range e.instanceMap {
+		if resourceID == "" || id == resourceID {
+			instances = append(instances, instance)
+		}
+	}
+	e.lock.RUnlock()
+	selected := instances[:0]
+	for _, instance := range instances {
+		if e.selected(instance) {
+			selected = append(selected, instance)
+		}
+	}
+	instances = selected
+
+	buf := make([]string, 0)
+	format := namespace + "_%s{%s} %f"
+	now := time.Now()
+	for _, instance := range instances {
+		label := e.instanceLabels(instance, targetLabels)
+		var interval float64
+		if instance.MonitoringInterval != nil {
+			interval = float64(*instance.MonitoringInterval)
+		}
+		enabled := 0.0
+		if interval > 0 && aws.ToString(instance.MonitoringRoleArn) != "" {
+			enabled = 1
+		}
+		buf = append(buf, fmt.Sprintf(format, "enabled", label, enabled))
+		buf = append(buf, fmt.Sprintf(format, "interval_seconds", label, interval))
+
+		e.streamLock.Lock()
+		lastEvent, ok := e.lastEvents[aws.ToString(instance.DbiResourceId)]
+		e.streamLock.Unlock()
+		if ok {
+			buf = append(buf, fmt.Sprintf(format, "last_event_age_seconds", label, now.Sub(time.UnixMilli(lastEvent)).Seconds()))
+		}
+	}
+	return buf
+}
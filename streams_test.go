@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cloudwatchlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// countingCloudWatchLogs returns two recent streams and two stale ones, and counts DescribeLogStreams calls.
+type countingCloudWatchLogs struct {
+	mockedCloudWatchLogs
+	calls atomic.Int32
+}
+
+func (c *countingCloudWatchLogs) DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	c.calls.Add(1)
+	now := time.Now()
+	return &cloudwatchlogs.DescribeLogStreamsOutput{
+		LogStreams: []cloudwatchlogsTypes.LogStream{
+			{LogStreamName: aws.String("db-AAAAAAAAAAAAAAAAAAAAAAAAAA"), LastEventTimestamp: aws.Int64(now.UnixMilli())},
+			{LogStreamName: aws.String("db-BBBBBBBBBBBBBBBBBBBBBBBBBB"), LastEventTimestamp: aws.Int64(now.Add(-time.Minute).UnixMilli())},
+			{LogStreamName: aws.String("db-ZZZZZZZZZZZZZZZZZZZZZZZZZZ"), LastEventTimestamp: aws.Int64(now.Add(-2 * time.Hour).UnixMilli())},
+			{LogStreamName: aws.String("db-CCCCCCCCCCCCCCCCCCCCCCCCCC"), LastEventTimestamp: aws.Int64(now.Add(-3 * time.Hour).UnixMilli())},
+		},
+	}, nil
+}
+
+func TestActiveStreamsCache(t *testing.T) {
+	client := &countingCloudWatchLogs{}
+	e := NewExporterWithClients(client, &mockedRDS{}, &mockedRGT{})
+
+	expect := []string{"db-AAAAAAAAAAAAAAAAAAAAAAAAAA", "db-BBBBBBBBBBBBBBBBBBBBBBBBBB"}
+	for i := 0; i < 3; i++ {
+		streams, err := e.activeStreams(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expect, streams) {
+			t.Errorf("expected %v, got %v", expect, streams)
+		}
+	}
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+
+	e.streamsFetchedAt = time.Now().Add(-2 * e.streamCacheTTL)
+	if _, err := e.activeStreams(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.calls.Load(); got != 2 {
+		t.Errorf("expected 2 calls after expiry, got %d", got)
+	}
+}
+
+func TestActiveStreamsFromInventory(t *testing.T) {
+	client := &countingCloudWatchLogs{}
+	e := NewExporterWithClients(client, &mockedRDS{}, &mockedRGT{})
+	e.streamSource = streamSourceInventory
+	e.instanceMap = map[string]rdsTypes.DBInstance{
+		"db-AAAAAAAAAAAAAAAAAAAAAAAAAA": {DbiResourceId: aws.String("db-AAAAAAAAAAAAAAAAAAAAAAAAAA"), MonitoringInterval: aws.Int32(60)},
+		"db-BBBBBBBBBBBBBBBBBBBBBBBBBB": {DbiResourceId: aws.String("db-BBBBBBBBBBBBBBBBBBBBBBBBBB"), MonitoringInterval: aws.Int32(0)},
+		"db-CCCCCCCCCCCCCCCCCCCCCCCCCC": {DbiResourceId: aws.String("db-CCCCCCCCCCCCCCCCCCCCCCCCCC"), MonitoringInterval: aws.Int32(1)},
+	}
+
+	streams, err := e.activeStreams(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"db-AAAAAAAAAAAAAAAAAAAAAAAAAA", "db-CCCCCCCCCCCCCCCCCCCCCCCCCC"}
+	if !reflect.DeepEqual(expect, streams) {
+		t.Errorf("expected %v, got %v", expect, streams)
+	}
+	if got := client.calls.Load(); got != 0 {
+		t.Errorf("expected DescribeLogStreams not to be called, got %d calls", got)
+	}
+}
+
+func TestInventoryMetrics(t *testing.T) {
+	e := NewExporterWithClients(&countingCloudWatchLogs{}, &mockedRDS{}, &mockedRGT{})
+	e.instanceMap = map[string]rdsTypes.DBInstance{
+		"db-AAAAAAAAAAAAAAAAAAAAAAAAAA": {
+			DbiResourceId:        aws.String("db-AAAAAAAAAAAAAAAAAAAAAAAAAA"),
+			DBInstanceIdentifier: aws.String("AAA"),
+			MonitoringInterval:   aws.Int32(60),
+			MonitoringRoleArn:    aws.String("arn:aws:iam::111111111111:role/rds-monitoring-role"),
+		},
+		"db-BBBBBBBBBBBBBBBBBBBBBBBBBB": {
+			DbiResourceId:        aws.String("db-BBBBBBBBBBBBBBBBBBBBBBBBBB"),
+			DBInstanceIdentifier: aws.String("BBB"),
+			MonitoringInterval:   aws.Int32(0),
+		},
+		"db-CCCCCCCCCCCCCCCCCCCCCCCCCC": {
+			DbiResourceId:        aws.String("db-CCCCCCCCCCCCCCCCCCCCCCCCCC"),
+			DBInstanceIdentifier: aws.String("CCC"),
+			MonitoringInterval:   aws.Int32(1),
+		},
+	}
+	if _, err := e.activeStreams(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for _, line := range e.inventoryMetrics("", []string{"DBInstanceIdentifier"}) {
+		got[line] = true
+	}
+	for _, expect := range []string{
+		`rds_enhanced_monitoring_enabled{DBInstanceIdentifier="AAA"} 1.000000`,
+		`rds_enhanced_monitoring_interval_seconds{DBInstanceIdentifier="AAA"} 60.000000`,
+		`rds_enhanced_monitoring_enabled{DBInstanceIdentifier="BBB"} 0.000000`,
+		`rds_enhanced_monitoring_interval_seconds{DBInstanceIdentifier="BBB"} 0.000000`,
+		// monitoring without a role never publishes
+		`rds_enhanced_monitoring_enabled{DBInstanceIdentifier="CCC"} 0.000000`,
+		`rds_enhanced_monitoring_interval_seconds{DBInstanceIdentifier="CCC"} 1.000000`,
+	} {
+		if !got[expect] {
+			t.Errorf("expected %s in %v", expect, got)
+		}
+	}
+
+	ages := 0
+	for line := range got {
+		if strings.HasPrefix(line, "rds_enhanced_monitoring_last_event_age_seconds") {
+			ages++
+		}
+	}
+	// the stream of CCC is stale, its age is reported all the same
+	if ages != 3 {
+		t.Errorf("expected age of the 3 streams seen by DescribeLogStreams, got %d", ages)
+	}
+
+	if lines := e.inventoryMetrics("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", nil); len(lines) != 3 {
+		t.Errorf("expected 3 series for a single instance, got %v", lines)
+	}
+
+	// the instances have neither DBSubnetGroup nor StorageType, their labels are left out
+	lines := e.inventoryMetrics("db-AAAAAAAAAAAAAAAAAAAAAAAAAA", []string{"DBInstanceIdentifier", "DBSubnetGroup.VpcId", "StorageType"})
+	expect := `rds_enhanced_monitoring_enabled{DBInstanceIdentifier="AAA"} 1.000000`
+	if len(lines) == 0 || lines[0] != expect {
+		t.Errorf("expected %s, got %v", expect, lines)
+	}
+}
+
+// slowCloudWatchLogs delays DescribeLogStreams until its delay elapses or ctx is done.
+type slowCloudWatchLogs struct {
+	countingCloudWatchLogs
+	delay time.Duration
+}
+
+func (c *slowCloudWatchLogs) DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.countingCloudWatchLogs.DescribeLogStreams(ctx, input, optFns...)
+}
+
+func TestActiveStreamsOutlivesCaller(t *testing.T) {
+	client := &slowCloudWatchLogs{delay: 100 * time.Millisecond}
+	e := NewExporterWithClients(client, &mockedRDS{}, &mockedRGT{})
+
+	// the scrape starting the listing times out, the one sharing it does not
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.activeStreams(ctx)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	streams, err := e.activeStreams(context.Background())
+	if err != nil {
+		t.Fatalf("expected the shared listing to complete, got %v", err)
+	}
+	if len(streams) != 2 {
+		t.Errorf("expected 2 streams, got %v", streams)
+	}
+	<-done
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	rdsTypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	rgtTypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	tagPrecedenceInstance = "instance"
+	tagPrecedenceCluster  = "cluster"
+
+	// tagSourceInstance reads the TagList returned by DescribeDBInstances and DescribeDBClusters.
+	tagSourceInstance = "instance"
+	// tagSourceAPI reads tags from the Resource Groups Tagging API, which needs tag:GetResources.
+	tagSourceAPI  = "api"
+	tagSourceBoth = "both"
+)
+
+func tagsToMap(tags []rgtTypes.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[*tag.Key] = *tag.Value
+	}
+	return m
+}
+
+func rdsTagsToMap(tags []rdsTypes.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if tag.Key != nil && tag.Value != nil {
+			m[*tag.Key] = *tag.Value
+		}
+	}
+	return m
+}
+
+func isAccessDenied(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "AccessDenied", "AccessDeniedException":
+			return true
+		}
+	}
+	return false
+}
+
+// collectTags resolves the tags of the given instances, keyed by DbiResourceId, and
+// of the given clusters, keyed by DBClusterIdentifier, from the configured sources.
+// With arns == nil the tagging API is paged for all RDS resources of the region,
+// otherwise only the given ARNs are requested. When the tagging API is denied the
+// exporter falls back to TagList for the rest of its lifetime.
+func (e *Exporter) collectTags(ctx context.Context, instances []rdsTypes.DBInstance, clusters []rdsTypes.DBCluster, arns []string) (map[string]map[string]string, map[string]map[string]string, error) {
+	useAPI := e.tagSource != tagSourceInstance && !e.tagAPIDenied.Load()
+	var mappings []rgtTypes.ResourceTagMapping
+	if useAPI {
+		var err error
+		mappings, err = e.getResources(ctx, arns)
+		if err != nil {
+			if !isAccessDenied(err) {
+				return nil, nil, err
+			}
+			slog.Warn("tag:GetResources is denied, falling back to TagList of DescribeDBInstances and DescribeDBClusters", "err", err)
+			e.tagAPIDenied.Store(true)
+			useAPI = false
+		}
+	}
+
+	tagMap := make(map[string]map[string]string)
+	clusterTagMap := make(map[string]map[string]string)
+	if e.tagSource != tagSourceAPI || !useAPI {
+		for _, instance := range instances {
+			tagMap[*instance.DbiResourceId] = rdsTagsToMap(instance.TagList)
+		}
+		for _, cluster := range clusters {
+			if cluster.DBClusterIdentifier != nil {
+				clusterTagMap[*cluster.DBClusterIdentifier] = rdsTagsToMap(cluster.TagList)
+			}
+		}
+	}
+	if !useAPI {
+		return tagMap, clusterTagMap, nil
+	}
+
+	// tags are correlated by ARN, so that they follow the resource across renames
+	instanceARNs := make(map[string]string)
+	for _, instance := range instances {
+		if instance.DBInstanceArn != nil {
+			instanceARNs[*instance.DBInstanceArn] = *instance.DbiResourceId
+		}
+	}
+	clusterARNs := make(map[string]string)
+	for _, cluster := range clusters {
+		if cluster.DBClusterArn != nil && cluster.DBClusterIdentifier != nil {
+			clusterARNs[*cluster.DBClusterArn] = *cluster.DBClusterIdentifier
+		}
+	}
+	for _, mapping := range mappings {
+		if resourceID, ok := instanceARNs[*mapping.ResourceARN]; ok {
+			tagMap[resourceID] = mergeTags(tagMap[resourceID], tagsToMap(mapping.Tags))
+		} else if clusterID, ok := clusterARNs[*mapping.ResourceARN]; ok {
+			clusterTagMap[clusterID] = mergeTags(clusterTagMap[clusterID], tagsToMap(mapping.Tags))
+		}
+	}
+	return tagMap, clusterTagMap, nil
+}
+
+func (e *Exporter) getResources(ctx context.Context, arns []string) ([]rgtTypes.ResourceTagMapping, error) {
+	input := &resourcegroupstaggingapi.GetResourcesInput{}
+	if arns == nil {
+		input.ResourceTypeFilters = []string{"rds:db", "rds:cluster"}
+		input.TagsPerPage = aws.Int32(500)
+	} else if len(arns) == 0 {
+		return nil, nil
+	} else {
+		input.ResourceARNList = arns
+	}
+
+	var mappings []rgtTypes.ResourceTagMapping
+	rgtPaginator := resourcegroupstaggingapi.NewGetResourcesPaginator(e.rgtClient, input)
+	for rgtPaginator.HasMorePages() {
+		output, err := rgtPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, output.ResourceTagMappingList...)
+	}
+	return mappings, nil
+}
+
+// mergeTags returns base overlaid with override.
+func mergeTags(base map[string]string, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// lookupTags returns the effective tags of an instance, which include the tags
+// inherited from its cluster, and the tags of the cluster itself.
+// When both define the same key, e.tagPrecedence decides which value wins.
+func (e *Exporter) lookupTags(instance rdsTypes.DBInstance) (map[string]string, map[string]string) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	instanceTags := e.tagMap[aws.ToString(instance.DbiResourceId)]
+	var clusterTags map[string]string
+	if instance.DBClusterIdentifier != nil {
+		clusterTags = e.clusterTagMap[*instance.DBClusterIdentifier]
+	}
+
+	if e.tagPrecedence == tagPrecedenceCluster {
+		return mergeTags(instanceTags, clusterTags), clusterTags
+	}
+	return mergeTags(clusterTags, instanceTags), clusterTags
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	rgt "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/smithy-go"
+)
+
+type deniedRGT struct {
+	calls int
+}
+
+func (c *deniedRGT) GetResources(ctx context.Context, input *rgt.GetResourcesInput, optFns ...func(*rgt.Options)) (*rgt.GetResourcesOutput, error) {
+	c.calls++
+	return nil, &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform: tag:GetResources"}
+}
+
+func TestLookupTags(t *testing.T) {
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	err := e.collectRdsInfo(context.Background())
+	if err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+	instance := e.instanceMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"]
+
+	tags, clusterTags := e.lookupTags(instance)
+	if tags["Environment"] != "production" {
+		t.Errorf("expected instance tag to win, got %s", tags["Environment"])
+	}
+	if tags["Team"] != "dba" {
+		t.Errorf("expected cluster tag to be inherited, got %s", tags["Team"])
+	}
+	if clusterTags["Environment"] != "staging" {
+		t.Errorf("expected cluster tag, got %s", clusterTags["Environment"])
+	}
+
+	e.tagPrecedence = tagPrecedenceCluster
+	tags, _ = e.lookupTags(instance)
+	if tags["Environment"] != "staging" {
+		t.Errorf("expected cluster tag to win, got %s", tags["Environment"])
+	}
+}
+
+func TestClusterTagLabels(t *testing.T) {
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	err := e.collectRdsInfo(context.Background())
+	if err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+	writer := httptest.NewRecorder()
+	request := &http.Request{
+		URL: &url.URL{
+			RawQuery: "ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA&labels[]=tag_Team&labels[]=cluster_tag_Environment",
+		},
+		RemoteAddr: "127.0.0.1:9408",
+	}
+	e.exportHandler(writer, request)
+
+	body, err := ioutil.ReadAll(writer.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := strings.Split(string(body), "\n")
+	sort.Strings(outputs)
+	got := outputs[0]
+	expect := "rds_enhanced_monitoring_CpuUtilization_Guest{cluster_tag_Environment=\"staging\",tag_Team=\"dba\"} 0.000000 1486977657000"
+	if expect != got {
+		t.Errorf("expected %s, got %s", expect, got)
+	}
+}
+
+func TestTagSourceInstance(t *testing.T) {
+	client := &deniedRGT{}
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		client,
+	)
+	e.tagSource = tagSourceInstance
+	err := e.collectRdsInfo(context.Background())
+	if err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+	if client.calls != 0 {
+		t.Errorf("expected tagging API not to be called, got %d calls", client.calls)
+	}
+
+	tags, _ := e.lookupTags(e.instanceMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"])
+	if tags["Environment"] != "production" {
+		t.Errorf("expected instance tag from TagList, got %s", tags["Environment"])
+	}
+	if tags["Team"] != "dba" {
+		t.Errorf("expected cluster tag from TagList, got %s", tags["Team"])
+	}
+}
+
+func TestTagSourceAccessDeniedFallback(t *testing.T) {
+	client := &deniedRGT{}
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		client,
+	)
+	e.tagSource = tagSourceAPI
+	for i := 0; i < 2; i++ {
+		err := e.collectRdsInfo(context.Background())
+		if err != nil {
+			t.Fatalf("collectRdsInfo failed: %v", err)
+		}
+	}
+	if client.calls != 1 {
+		t.Errorf("expected tagging API to be called once, got %d calls", client.calls)
+	}
+
+	tags, _ := e.lookupTags(e.instanceMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"])
+	if tags["Environment"] != "production" {
+		t.Errorf("expected instance tag from TagList, got %s", tags["Environment"])
+	}
+}
+
+func TestTagLabelEscaping(t *testing.T) {
+	e := NewExporterWithClients(
+		&mockedCloudWatchLogs{},
+		&mockedRDS{},
+		&mockedRGT{},
+	)
+	err := e.collectRdsInfo(context.Background())
+	if err != nil {
+		t.Fatalf("collectRdsInfo failed: %v", err)
+	}
+	e.tagMap["db-AAAAAAAAAAAAAAAAAAAAAAAAAA"]["Team"] = "a \"b\" \\c }\nd"
+
+	expect := `rds_enhanced_monitoring_CpuUtilization_Guest{tag_Team="a \"b\" \\c }\nd"} 0.000000 1486977657`
+	for _, accept := range []string{"", "application/openmetrics-text;version=1.0.0"} {
+		writer := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/metrics?ResourceId=db-AAAAAAAAAAAAAAAAAAAAAAAAAA&labels[]=tag_Team", nil)
+		request.Header.Set("Accept", accept)
+		e.exportHandler(writer, request)
+
+		body := writer.Body.String()
+		if !strings.Contains(body, expect) {
+			t.Errorf("expected %s with Accept %q, got %s", expect, accept, body)
+		}
+	}
+}
@@ -1,10 +1,29 @@
 package main
 
 import (
+	"reflect"
 	"sort"
 	"strings"
 )
 
+// Kinds of the numeric fields of RDSOSMetrics, set with the metric struct tag.
+// A gauge, the default, is a value at the time of the event. A rate is a value
+// per second averaged over the monitoring interval. A delta is a total over the
+// monitoring interval, which can be accumulated into a counter.
+const (
+	fieldGauge = "gauge"
+	fieldRate  = "rate"
+	fieldDelta = "delta"
+)
+
+// fieldKind returns the kind of a numeric field of RDSOSMetrics.
+func fieldKind(f reflect.StructField) string {
+	if kind := f.Tag.Get("metric"); kind != "" {
+		return kind
+	}
+	return fieldGauge
+}
+
 type RDSOSMetrics struct {
 	CpuUtilization     CpuUtilization     `json:"cpuUtilization"`
 	DiskIO             []DiskIO           `json:"diskIO"`
@@ -41,38 +60,38 @@ type DiskIO struct {
 	AvgReqSz        float64 `json:"avgReqSz"`
 	Await           float64 `json:"await"`
 	Device          string  `json:"device"`
-	ReadIOsPS       float64 `json:"readIOsPS"`
-	ReadKb          float64 `json:"readKb"`
-	ReadKbPS        float64 `json:"readKbPS"`
-	RrqmPS          float64 `json:"rrqmPS"`
-	Tps             float64 `json:"tps"`
+	ReadIOsPS       float64 `json:"readIOsPS" metric:"rate"`
+	ReadKb          float64 `json:"readKb" metric:"delta"`
+	ReadKbPS        float64 `json:"readKbPS" metric:"rate"`
+	RrqmPS          float64 `json:"rrqmPS" metric:"rate"`
+	Tps             float64 `json:"tps" metric:"rate"`
 	Util            float64 `json:"util"`
-	WriteIOsPS      float64 `json:"writeIOsPS"`
-	WriteKb         float64 `json:"writeKb"`
-	WriteKbPS       float64 `json:"writeKbPS"`
-	WrqmPS          float64 `json:"wrqmPS"`
+	WriteIOsPS      float64 `json:"writeIOsPS" metric:"rate"`
+	WriteKb         float64 `json:"writeKb" metric:"delta"`
+	WriteKbPS       float64 `json:"writeKbPS" metric:"rate"`
+	WrqmPS          float64 `json:"wrqmPS" metric:"rate"`
 	ReadLatency     float64 `json:"readLatency"`
 	WriteLatency    float64 `json:"writeLatency"`
-	ReadThroughput  float64 `json:"readThroughput"`
-	WriteThroughput float64 `json:"writeThroughput"`
+	ReadThroughput  float64 `json:"readThroughput" metric:"rate"`
+	WriteThroughput float64 `json:"writeThroughput" metric:"rate"`
 	DiskQueueDepth  float64 `json:"diskQueueDepth"`
 }
 
 type PhysicalDeviceIO struct {
-	WriteKbPS   float64 `json:"writeKbPS`
-	ReadIOsPS   float64 `json:"readIOsPS`
-	Await       float64 `json:"await`
-	ReadKbPS    float64 `json:"readKbPS`
-	RrqmPS      float64 `json:"rrqmPS`
-	Util        float64 `json:"util`
-	AvgQueueLen float64 `json:"avgQueueLen`
-	Tps         float64 `json:"tps`
-	ReadKb      float64 `json:"readKb`
-	Device      string  `json:"device`
-	WriteKb     float64 `json:"writeKb`
-	AvgReqSz    float64 `json:"avgReqSz`
-	WrqmPS      float64 `json:"wrqmPS`
-	WriteIOsPS  float64 `json:"writeIOsPS`
+	WriteKbPS   float64 `json:"writeKbPS" metric:"rate"`
+	ReadIOsPS   float64 `json:"readIOsPS" metric:"rate"`
+	Await       float64 `json:"await"`
+	ReadKbPS    float64 `json:"readKbPS" metric:"rate"`
+	RrqmPS      float64 `json:"rrqmPS" metric:"rate"`
+	Util        float64 `json:"util"`
+	AvgQueueLen float64 `json:"avgQueueLen"`
+	Tps         float64 `json:"tps" metric:"rate"`
+	ReadKb      float64 `json:"readKb" metric:"delta"`
+	Device      string  `json:"device"`
+	WriteKb     float64 `json:"writeKb" metric:"delta"`
+	AvgReqSz    float64 `json:"avgReqSz"`
+	WrqmPS      float64 `json:"wrqmPS" metric:"rate"`
+	WriteIOsPS  float64 `json:"writeIOsPS" metric:"rate"`
 }
 
 type FileSys struct {
@@ -113,14 +132,14 @@ type Memory struct {
 
 type Network struct {
 	Interface string  `json:"interface"`
-	Rx        float64 `json:"rx"`
-	Tx        float64 `json:"tx"`
+	Rx        float64 `json:"rx" metric:"rate"`
+	Tx        float64 `json:"tx" metric:"rate"`
 }
 type Swap struct {
 	Cached float64 `json:"cached"`
 	Free   float64 `json:"free"`
-	In     float64 `json:"in"`
-	Out    float64 `json:"out"`
+	In     float64 `json:"in" metric:"delta"`
+	Out    float64 `json:"out" metric:"delta"`
 	Total  float64 `json:"total"`
 }
 type Tasks struct {
@@ -134,10 +153,13 @@ type Tasks struct {
 
 type Labels map[string]string
 
+// labelValueEscaper escapes label values as the exposition formats require.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
 func (l Labels) String() string {
 	r := make([]string, 0)
 	for k, v := range l {
-		r = append(r, k+"=\""+v+"\"")
+		r = append(r, k+"=\""+labelValueEscaper.Replace(v)+"\"")
 	}
 	sort.Strings(r)
 	return strings.Join(r, ",")
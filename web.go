@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// WebConfig is the web configuration file, following the format of the
+// Prometheus exporter-toolkit.
+type WebConfig struct {
+	TLSConfig      TLSConfig         `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientAuth   string `yaml:"client_auth_type"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+func LoadWebConfig(configFile string) (*WebConfig, error) {
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg WebConfig
+	err = yaml.UnmarshalStrict(buf, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func (c *WebConfig) validate() error {
+	t := c.TLSConfig
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	clientAuth, ok := clientAuthTypes[t.ClientAuth]
+	if !ok {
+		return fmt.Errorf("invalid client_auth_type: %s", t.ClientAuth)
+	}
+	if t.ClientCAFile != "" && clientAuth == tls.NoClientCert {
+		return errors.New("client_ca_file is set without client_auth_type")
+	}
+	if t.CertFile == "" && (t.ClientCAFile != "" || t.ClientAuth != "") {
+		return errors.New("client authentication requires cert_file and key_file")
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for user %s: %w", user, err)
+		}
+	}
+	return nil
+}
+
+func (c *WebConfig) tlsEnabled() bool {
+	return c.TLSConfig.CertFile != ""
+}
+
+// tlsConfig builds a tls.Config from the certificate files.
+func (t *TLSConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthTypes[t.ClientAuth],
+	}
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+	}
+	return cfg, nil
+}
+
+// newWebTLSConfig returns a tls.Config that reloads the web configuration file,
+// and the certificates it refers to, on every TLS handshake, so that rotated
+// certificates are picked up without a restart.
+func newWebTLSConfig(configFile string) (*tls.Config, error) {
+	cfg, err := LoadWebConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cfg.TLSConfig.tlsConfig(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := LoadWebConfig(configFile)
+			if err != nil {
+				return nil, err
+			}
+			return cfg.TLSConfig.tlsConfig()
+		},
+	}, nil
+}
+
+// dummyBcryptHash is compared against for unknown users, so that they take as
+// long to be rejected as known users with a wrong password.
+const dummyBcryptHash = "$2a$10$It28K.ZcFObwBAE02mgDsuxUoeyQM7LpdD5st16.aNd3.C80DUdFm"
+
+// basicAuthHandler requires one of the basic_auth_users of the web configuration
+// file, which is read on every request. Successful verifications are cached
+// because bcrypt is deliberately slow.
+type basicAuthHandler struct {
+	configFile string
+	handler    http.Handler
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]bool
+}
+
+func newBasicAuthHandler(configFile string, handler http.Handler) *basicAuthHandler {
+	return &basicAuthHandler{
+		configFile: configFile,
+		handler:    handler,
+		cache:      make(map[[sha256.Size]byte]bool),
+	}
+}
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg, err := LoadWebConfig(h.configFile)
+	if err != nil {
+		http.Error(w, "failed to load web configuration", http.StatusInternalServerError)
+		return
+	}
+	if len(cfg.BasicAuthUsers) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		hash, found := cfg.BasicAuthUsers[user]
+		if !found {
+			bcrypt.CompareHashAndPassword([]byte(dummyBcryptHash), []byte(pass))
+		} else if h.verify(user, hash, pass) {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	w.Header().Set("WWW-Authenticate", "Basic")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (h *basicAuthHandler) verify(user string, hash string, pass string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	h.mu.Lock()
+	cached := h.cache[key]
+	h.mu.Unlock()
+	if cached {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	h.mu.Lock()
+	h.cache[key] = true
+	h.mu.Unlock()
+	return true
+}
+
+// listenAndServe serves with TLS and basic authentication when a web
+// configuration file is given.
+func listenAndServe(server *http.Server, webConfigFile string) error {
+	if webConfigFile == "" {
+		return server.ListenAndServe()
+	}
+
+	cfg, err := LoadWebConfig(webConfigFile)
+	if err != nil {
+		return err
+	}
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = newBasicAuthHandler(webConfigFile, handler)
+	if !cfg.tlsEnabled() {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig, err = newWebTLSConfig(webConfigFile)
+	if err != nil {
+		return err
+	}
+	return server.ListenAndServeTLS("", "")
+}
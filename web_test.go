@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, serial int64, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "rds_enhanced_monitoring_exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         isCA,
+
+		BasicConstraintsValid: true,
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	t.Helper()
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func writeWebConfig(t *testing.T, dir string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "web.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestTLSServer(t *testing.T, webConfigFile string) *httptest.Server {
+	t.Helper()
+	tlsConfig, err := newWebTLSConfig(webConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewUnstartedServer(newBasicAuthHandler(webConfigFile, handler))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestClient(ca *testCert, clientCert *testCert) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+}
+
+func TestWebConfigTLSAndBasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, 1, nil, true)
+	ca.write(t, filepath.Join(dir, "ca.crt"), "")
+	newTestCert(t, 2, ca, false).write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: `+filepath.Join(dir, "server.crt")+`
+  key_file: `+filepath.Join(dir, "server.key")+`
+basic_auth_users:
+  prometheus: `+string(hash)+`
+`)
+	server := newTestTLSServer(t, configFile)
+	client := newTestClient(ca, nil)
+
+	tests := []struct {
+		user   string
+		pass   string
+		status int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"unknown", "secret", http.StatusUnauthorized},
+		{"prometheus", "secret", http.StatusOK},
+		{"prometheus", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s:%s: expected %d, got %d", tt.user, tt.pass, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestWebConfigClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, 1, nil, true)
+	ca.write(t, filepath.Join(dir, "ca.crt"), "")
+	newTestCert(t, 2, ca, false).write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	configFile := writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: `+filepath.Join(dir, "server.crt")+`
+  key_file: `+filepath.Join(dir, "server.key")+`
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: `+filepath.Join(dir, "ca.crt")+`
+`)
+	server := newTestTLSServer(t, configFile)
+
+	if _, err := newTestClient(ca, nil).Get(server.URL); err == nil {
+		t.Error("expected request without client certificate to fail")
+	}
+	resp, err := newTestClient(ca, newTestCert(t, 3, ca, false)).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestWebConfigCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, 1, nil, true)
+	newTestCert(t, 2, ca, false).write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	configFile := writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: `+filepath.Join(dir, "server.crt")+`
+  key_file: `+filepath.Join(dir, "server.key")+`
+`)
+	server := newTestTLSServer(t, configFile)
+	client := newTestClient(ca, nil)
+
+	for _, serial := range []int64{2, 3} {
+		if serial != 2 {
+			newTestCert(t, serial, ca, false).write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); got != serial {
+			t.Errorf("expected serial %d, got %d", serial, got)
+		}
+	}
+}
+
+func TestLoadWebConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []string{
+		"tls_server_config:\n  cert_file: server.crt\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_auth_type: Always\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: ca.crt\n",
+		"basic_auth_users:\n  prometheus: plaintext\n",
+		"unknown_key: true\n",
+	}
+	for _, content := range tests {
+		if _, err := LoadWebConfig(writeWebConfig(t, dir, content)); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
+func TestDummyBcryptHash(t *testing.T) {
+	// an invalid hash would be rejected without the cost of a comparison
+	cost, err := bcrypt.Cost([]byte(dummyBcryptHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("expected cost %d, got %d", bcrypt.DefaultCost, cost)
+	}
+}